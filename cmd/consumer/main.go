@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
@@ -34,26 +35,31 @@ func main() {
 	cn, err := disruptor.NewConsumer(&disruptor.ConsumerOptions{
 		Consumer:  fmt.Sprintf("%v_%v", serverName, nodeID),
 		QueueName: msgQueueName,
+		Codec:     disruptor.GzipJSON,
 	}, client)
 
 	if err != nil {
 		panic(err)
 	}
 
-	p := &entity.Player{}
-	more := true
-	for more {
-		_, more = cn.Pop(p, func(_ disruptor.Message) error {
-			println(p.UserId, p.NickName)
-			return nil
-		})
-	}
+	ctx, cancel := context.WithCancel(context.Background())
 
 	// 监听信号
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
-	<-ch
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+		<-ch
+		cancel()
+	}()
 
-	cn.Close()
+	// 8 个协程并发处理不同分片的消息，同一个玩家的消息按顺序处理
+	_ = cn.Run(ctx, 8, func() disruptor.Marshaler {
+		return cn.Value(&entity.Player{})
+	}, func(m disruptor.Message) error {
+		p := m.Data.(*entity.Player)
+		println(p.UserId, p.NickName)
+		return nil
+	})
 
+	cn.Close()
 }
@@ -24,6 +24,7 @@ func main() {
 		app.Conf(),
 		app.LogLevel(),
 		app.Named(),
+		app.Redis(),
 		app.Dao(),
 		app.UseCase(),
 		app.Controller(),
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -33,6 +36,8 @@ func main() {
 
 	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{
 		QueueName: msgQueueName,
+		Codec:     disruptor.GzipJSON,
+		SpillDir:  filepath.Join(os.TempDir(), "tile", msgQueueName), // 重启后继续发送上次没有发送的消息，不写入代码目录
 	}, client)
 
 	if err != nil {
@@ -53,7 +58,12 @@ func main() {
 	r.GET("/", func(ctx *gin.Context) {
 		p.NickName = fmt.Sprintf("robot_%v", atomic.AddInt64(&inx, 1))
 		p.UserIp = ctx.Request.RemoteAddr
-		pr.Push(p)
+
+		// 本地缓冲满了直接拒绝，不阻塞请求协程
+		if err := pr.TryPush(pr.Value(p)); err != nil {
+			ctx.String(http.StatusServiceUnavailable, err.Error())
+			return
+		}
 	})
 
 	r.Run(":8090")
@@ -62,5 +72,11 @@ func main() {
 	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
 	<-ch
 
-	pr.Close()
+	// 最多等待10秒，没有发送的消息留在本地文件中，下次启动时重新发送
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if dropped, err := pr.CloseContext(ctx); err != nil {
+		fmt.Printf("close producer: %v, dropped %v\n", err, dropped)
+	}
 }
@@ -1,20 +1,29 @@
 module github.com/sinuxlee/tile
 
-go 1.14
+go 1.16
 
 require (
+	github.com/alicebob/miniredis/v2 v2.31.1
 	github.com/boltdb/bolt v1.3.1 // indirect
 	github.com/docker/libkv v0.2.1
 	github.com/gin-contrib/cors v1.3.1
 	github.com/gin-contrib/pprof v1.3.0
 	github.com/gin-gonic/gin v1.6.3
 	github.com/go-redis/redis/v7 v7.4.0
+	github.com/golang/protobuf v1.4.2
+	github.com/golang/snappy v0.0.4
 	github.com/hashicorp/consul/api v1.7.0 // indirect
 	github.com/imdario/mergo v0.3.11
 	github.com/juju/ratelimit v1.0.1 // indirect
 	github.com/julianshen/gin-limiter v0.0.0-20161123033831-fc39b5e90fe7
+	github.com/nats-io/nats-server/v2 v2.2.6
+	github.com/nats-io/nats.go v1.11.0
 	github.com/pkg/errors v0.8.1
+	github.com/prometheus/client_golang v1.7.1
+	github.com/prometheus/client_model v0.2.0
 	github.com/rs/zerolog v1.20.0
 	github.com/ssgreg/repeat v1.5.1
-	github.com/stretchr/testify v1.4.0
+	github.com/stretchr/testify v1.7.0
+	github.com/ugorji/go/codec v1.1.7
+	golang.org/x/sys v0.0.0-20201119102817-f84b799fce68
 )
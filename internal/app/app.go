@@ -13,6 +13,7 @@ import (
 	"github.com/sinuxlee/tile/pkg/nid"
 
 	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
 	"github.com/rs/zerolog/log"
 )
 
@@ -51,6 +52,7 @@ type app struct {
 	useCase     service.UseCase
 	dao         store.Dao
 	named       nid.NodeNamed
+	redisCli    redis.UniversalClient
 }
 
 func (s *app) GetServiceID() int {
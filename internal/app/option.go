@@ -9,6 +9,7 @@ import (
 	"github.com/gin-contrib/cors"
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
 	"github.com/pkg/errors"
 	"github.com/sinuxlee/tile/internal/config"
 	"github.com/sinuxlee/tile/internal/controller"
@@ -87,7 +88,7 @@ func Controller() Option {
 // Dao ...
 func Dao() Option {
 	return func(a *app) (err error) {
-		a.dao = store.NewDao(a.named)
+		a.dao = store.NewDao(a.named, a.redisCli)
 		if a.dao == nil {
 			return errors.New("create dao failed")
 		}
@@ -142,6 +143,16 @@ func HTTPServer() Option {
 	}
 }
 
+// Redis ...
+func Redis() Option {
+	return func(a *app) (err error) {
+		a.redisCli = redis.NewClient(&redis.Options{
+			Addr: a.conf.GetRedisAddr(),
+		})
+		return
+	}
+}
+
 func Named() Option {
 	return func(a *app) (err error) {
 		a.named, err = nid.NewConsulNamed(a.conf.GetConsulAddr())
@@ -18,6 +18,9 @@ type AppConf interface {
 
 	// consul地址
 	GetConsulAddr() string
+
+	// redis地址
+	GetRedisAddr() string
 }
 
 // appConfig 服务配置
@@ -27,6 +30,7 @@ type appConfig struct {
 	HTTPPort   int    `json:"httpPort"`
 	NodeID     int    `json:"nodeId"`
 	ConsulAddr string `json:"consulAddr"`
+	RedisAddr  string `json:"redisAddr"`
 }
 
 // IsDebugMode ...
@@ -53,6 +57,10 @@ func (s *appConfig) GetConsulAddr() string {
 	return s.ConsulAddr
 }
 
+func (s *appConfig) GetRedisAddr() string {
+	return s.RedisAddr
+}
+
 // 加载服务相关配置
 func loadServerConf(filePath string, c *config) bool {
 	return loadConfFromFile(filePath, &c.appConfig)
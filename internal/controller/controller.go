@@ -6,10 +6,15 @@ import (
 
 type Controller interface {
 	GetNodeID(*gin.Context)
+	InspectQueue(*gin.Context)
 }
 
 func RegisterHandler(engine *gin.Engine, ctrl Controller, debugMode bool) {
 	group1 := engine.Group("/named/v1")
 	group1.GET("/:serverName/nodeid", ctrl.GetNodeID)
 	group1.POST("/:serverName/nodeid", ctrl.GetNodeID)
+
+	// 队列状态，只读
+	group2 := engine.Group("/disruptor/v1")
+	group2.GET("/queues/:queue", ctrl.InspectQueue)
 }
@@ -10,6 +10,7 @@ const (
 	CodeVerifyToken                // 验证access token 出错
 	CodeIllegalToken               // 非法token
 	CodeNodeID                     // 获取 node id 失败
+	CodeQueueInfo                  // 获取队列状态失败
 )
 
 func init() {
@@ -20,4 +21,5 @@ func init() {
 	codeText[CodeVerifyToken] = "something wrong when verify token"
 	codeText[CodeIllegalToken] = "illegal token"
 	codeText[CodeNodeID] = "failed to get node id"
+	codeText[CodeQueueInfo] = "failed to inspect queue"
 }
@@ -32,6 +32,11 @@ func (c *ControllerOnHttp) ResponseWithData(ctx *gin.Context, data interface{})
 
 // ResponseWithCode ...
 func (c *ControllerOnHttp) ResponseWithCode(ctx *gin.Context, code int) {
+	c.ResponseWithStatus(ctx, http.StatusOK, code)
+}
+
+// ResponseWithStatus 和 ResponseWithCode 相同，HTTP 状态码为 status
+func (c *ControllerOnHttp) ResponseWithStatus(ctx *gin.Context, status int, code int) {
 	resp := &Response{ErrCode: code}
 	desc, ok := codeText[code]
 	if ok {
@@ -40,7 +45,7 @@ func (c *ControllerOnHttp) ResponseWithCode(ctx *gin.Context, code int) {
 		resp.ErrDesc = "unknown codeText"
 	}
 
-	ctx.JSON(http.StatusOK, resp)
+	ctx.JSON(status, resp)
 	if code != CodeSuccess {
 		c.ErrorLog(ctx, resp)
 	}
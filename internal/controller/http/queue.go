@@ -0,0 +1,41 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sinuxlee/tile/pkg/disruptor"
+)
+
+func (c *ControllerOnHttp) InspectQueue(ctx *gin.Context) {
+	queue := ctx.Param("queue")
+	if queue == "" {
+		c.ResponseWithCode(ctx, CodeLackParam)
+		return
+	}
+
+	shards := 0 // 没有指定时使用队列描述中的分片数量
+	if s := ctx.Query("shards"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > disruptor.MaxShards {
+			c.ResponseWithStatus(ctx, http.StatusBadRequest, CodeInvalidParam)
+			return
+		}
+		shards = n
+	}
+
+	info, err := c.useCase.InspectQueue(queue, ctx.Query("group"), shards)
+	if errors.Is(err, disruptor.ErrTooManyShards) {
+		c.ResponseWithStatus(ctx, http.StatusBadRequest, CodeInvalidParam)
+		return
+	}
+
+	if err != nil {
+		c.ResponseWithDesc(ctx, CodeQueueInfo, err.Error())
+		return
+	}
+
+	c.ResponseWithData(ctx, info)
+}
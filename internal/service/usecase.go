@@ -1,9 +1,13 @@
 package service
 
-import "github.com/sinuxlee/tile/internal/store"
+import (
+	"github.com/sinuxlee/tile/internal/store"
+	"github.com/sinuxlee/tile/pkg/disruptor"
+)
 
 type UseCase interface {
 	GetNodeID(path, addr, service string) (int, error)
+	InspectQueue(queue string, group string, shards int) (*disruptor.QueueInfo, error)
 }
 
 func NewUseCase(d store.Dao) UseCase {
@@ -19,3 +23,7 @@ type useCaseImpl struct {
 func (c *useCaseImpl) GetNodeID(path, addr, service string) (int, error) {
 	return c.dao.GetNodeID(path, addr, service)
 }
+
+func (c *useCaseImpl) InspectQueue(queue string, group string, shards int) (*disruptor.QueueInfo, error) {
+	return c.dao.InspectQueue(queue, group, shards)
+}
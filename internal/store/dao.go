@@ -1,6 +1,10 @@
 package store
 
-import "github.com/sinuxlee/tile/pkg/nid"
+import (
+	"github.com/go-redis/redis/v7"
+	"github.com/sinuxlee/tile/pkg/disruptor"
+	"github.com/sinuxlee/tile/pkg/nid"
+)
 
 const (
 	nodeIdRoot = "nodeId/"
@@ -8,16 +12,19 @@ const (
 
 type Dao interface {
 	GetNodeID(path, addr, service string) (int, error)
+	InspectQueue(queue string, group string, shards int) (*disruptor.QueueInfo, error)
 }
 
-func NewDao(named nid.NodeNamed) Dao {
+func NewDao(named nid.NodeNamed, rds redis.UniversalClient) Dao {
 	return &daoImpl{
-		nodeNamed: named,
+		nodeNamed:   named,
+		redisClient: rds,
 	}
 }
 
 type daoImpl struct {
-	nodeNamed nid.NodeNamed
+	nodeNamed   nid.NodeNamed
+	redisClient redis.UniversalClient
 }
 
 func (d *daoImpl) GetNodeID(path, addr, service string) (int, error) {
@@ -27,3 +34,7 @@ func (d *daoImpl) GetNodeID(path, addr, service string) (int, error) {
 		ServiceKey: nodeIdRoot + service,
 	})
 }
+
+func (d *daoImpl) InspectQueue(queue string, group string, shards int) (*disruptor.QueueInfo, error) {
+	return disruptor.Inspect(d.redisClient, queue, group, shards)
+}
@@ -0,0 +1,213 @@
+package disruptor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// BatchHandler 一次处理一批消息。返回 nil 时整批 ack；返回 *BatchError 时只有其中的消息按失败处理，
+// 其他消息 ack；返回其他错误时整批按失败处理。失败的消息按重试策略一起重试，最终失败的进入死信队列
+type BatchHandler func(ms []Message) error
+
+// BatchError 批量处理中失败的消息，key 为消息在 ms 中的下标
+type BatchError struct {
+	Failed map[int]error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("disruptor: %v messages failed in batch", len(e.Failed))
+}
+
+func (c *consumer) PopBatch(ctx context.Context, max int, wait time.Duration, factory func() Marshaler, h BatchHandler) (error, bool) {
+	ms, err, more := popBatch(ctx, c.msgChan, max, wait)
+	if len(ms) == 0 {
+		return err, more
+	}
+
+	return c.handleBatch(ms, factory, h), more
+}
+
+// handleBatch 去重和解码后交给 h 处理，解码失败的消息直接进入死信队列，不会交给 h
+func (c *consumer) handleBatch(ms []Message, factory func() Marshaler, h BatchHandler) error {
+	defer func() {
+		for _, m := range ms {
+			c.release(m)
+		}
+	}()
+
+	batch := make([]Message, 0, len(ms))
+	for _, m := range ms {
+		if c.DedupWindow > 0 {
+			ok, err := c.dedupBegin(m)
+			if err != nil && c.emitter != nil {
+				c.emitter.EmitError(err)
+			}
+
+			if err != nil || !ok {
+				continue
+			}
+		}
+
+		m, err := decodeMessage(m, factory())
+		if err != nil {
+			c.fail(m, err, 1)
+			continue
+		}
+
+		batch = append(batch, m)
+	}
+
+	return retryBatch(batch, h, &c.Retry, func(m Message) {
+		c.dedupEnd(m, true)
+		c.ack(m)
+	}, c.fail)
+}
+
+func (c *memConsumer) PopBatch(ctx context.Context, max int, wait time.Duration, factory func() Marshaler, h BatchHandler) (error, bool) {
+	ms, err, more := popBatch(ctx, c.msgChan, max, wait)
+	if len(ms) == 0 {
+		return err, more
+	}
+
+	return c.handleBatch(ms, factory, h), more
+}
+
+func (c *memConsumer) handleBatch(ms []Message, factory func() Marshaler, h BatchHandler) error {
+	defer c.inflight.Add(-len(ms))
+
+	batch := make([]Message, 0, len(ms))
+	for _, m := range ms {
+		m, err := decodeMessage(m, factory())
+		if err != nil {
+			c.fail(m, err, 1)
+			continue
+		}
+
+		batch = append(batch, m)
+	}
+
+	return retryBatch(batch, h, &c.Retry, c.ack, c.fail)
+}
+
+// popBatch 不限时等待第一条消息，之后最多再等待 wait 收集到 max 条。
+// 已经取出的消息即使 ctx 结束或者 msgChan 关闭也返回，只有没有取到消息时才返回 ctx.Err() 或者 false
+func popBatch(ctx context.Context, msgChan <-chan Message, max int, wait time.Duration) ([]Message, error, bool) {
+	if max <= 0 {
+		max = 1
+	}
+
+	var ms []Message
+	select {
+	case m, more := <-msgChan:
+		if !more {
+			return nil, nil, more
+		}
+
+		ms = append(ms, m)
+	case <-ctx.Done():
+		return nil, ctx.Err(), true
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for len(ms) < max {
+		select {
+		case m, more := <-msgChan:
+			if !more {
+				return ms, nil, true
+			}
+
+			ms = append(ms, m)
+		case <-timer.C:
+			return ms, nil, true
+		case <-ctx.Done():
+			return ms, nil, true
+		}
+	}
+
+	return ms, nil, true
+}
+
+// decodeMessage 把消息体解码到 data，Message.Data 为解码后的值
+func decodeMessage(m Message, data Marshaler) (Message, error) {
+	if err := data.Unmarshal(m.Body); err != nil {
+		return m, err
+	}
+
+	m.Data = data
+	if v, ok := data.(*codecValue); ok {
+		m.Data = v.v
+	}
+
+	return m, nil
+}
+
+// retryBatch 把 ms 交给 h 处理，成功的消息交给 ack，失败的消息按 retry 一起重试，最终失败的交给 fail。
+// 返回最后一次处理的错误，全部成功时返回 nil
+func retryBatch(ms []Message, h BatchHandler, retry *RetryPolicy, ack func(m Message),
+	fail func(m Message, cause error, attempts int)) error {
+	safe := recoverBatchHandler(h)
+	for attempts := 1; len(ms) > 0; attempts++ {
+		err := safe(ms)
+		if err == nil {
+			for _, m := range ms {
+				ack(m)
+			}
+
+			return nil
+		}
+
+		var be *BatchError
+		partial := errors.As(err, &be)
+
+		failed := make([]Message, 0, len(ms))
+		causes := make([]error, 0, len(ms))
+		for i, m := range ms {
+			cause := err
+			if partial {
+				cause = be.Failed[i]
+			}
+
+			if cause == nil {
+				ack(m)
+				continue
+			}
+
+			failed = append(failed, m)
+			causes = append(causes, cause)
+		}
+
+		if len(failed) == 0 {
+			return nil
+		}
+
+		if attempts >= retry.MaxAttempts {
+			for i, m := range failed {
+				fail(m, causes[i], attempts)
+			}
+
+			return err
+		}
+
+		time.Sleep(retry.delay(attempts))
+		ms = failed
+	}
+
+	return nil
+}
+
+// recoverBatchHandler 把 handler 的 panic 转换成整批失败
+func recoverBatchHandler(h BatchHandler) BatchHandler {
+	return func(ms []Message) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("disruptor: batch handler panic on %v messages: %v", len(ms), r)
+			}
+		}()
+
+		return h(ms)
+	}
+}
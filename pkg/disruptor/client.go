@@ -1,20 +1,51 @@
 package disruptor
 
 import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
 	"github.com/go-redis/redis/v7"
 )
 
 type client struct {
 	streamName  string                // 队列名称
-	shardsCount int8                  // 队列分片数量
-	redisClient redis.UniversalClient // 抽象客户端连接
+	shardsCount int32                 // 队列分片数量，重新分片后会增加，需要原子访问
+	codec       string                // 队列的编码方式
+	redisClient redis.UniversalClient // 抽象客户端连接，使用其他后端时为 nil
+	driver      Driver                // 队列的存储后端
+	lanes       int                   // 优先级的数量，每个优先级使用一组分片，以队列描述和配置中较大的为准
+	naming      Naming                // 创建队列时选择分片的 hash tag
+	tags        *shardTags            // 各个分片的 hash tag，以队列描述为准
+}
+
+// selectDriver 没有设置 driver 时使用 rd，设置时不使用 Redis 客户端
+func selectDriver(driver Driver, rd *redisDriver) (Driver, redis.UniversalClient) {
+	if driver == nil {
+		return rd, rd.cli
+	}
+
+	return driver, nil
 }
 
-func newClient(stream string, shard int8, cli redis.UniversalClient) (*client, error) {
+func newClient(stream string, shard int8, codec string, lanes int, naming Naming, cli redis.UniversalClient, driver Driver) (*client, error) {
+	if lanes < 1 {
+		lanes = 1
+	}
+
 	c := &client{
 		streamName:  stream,
-		shardsCount: shard,
+		shardsCount: int32(shard),
+		codec:       codec,
 		redisClient: cli,
+		driver:      driver,
+		lanes:       lanes,
+		naming:      naming,
+		tags:        &shardTags{},
+	}
+
+	if d, ok := driver.(*redisDriver); ok {
+		d.tags = c.tags
 	}
 
 	err := c.init()
@@ -26,37 +57,94 @@ func newClient(stream string, shard int8, cli redis.UniversalClient) (*client, e
 }
 
 func (c *client) init() error {
-	group := makeGroupName(c.streamName)
-
-	for i := 0; i < int(c.shardsCount); i++ {
-		stream := makeStreamName(c.streamName, i)
-		err := c.createShard(stream, group)
+	// 队列已经存在时以 Redis 中的描述为准，其他后端以配置为准
+	if c.redisClient != nil {
+		desc, err := loadDescriptor(c.redisClient, c.streamName, c.shards(), c.lanes, c.codec, c.naming)
 		if err != nil {
 			return err
 		}
+
+		c.tags.set(desc.Tags)
+		atomic.StoreInt32(&c.shardsCount, int32(desc.Shards))
+
+		// 其他生产者或者消费者配置了更多的优先级时也读取和写入这些优先级的分片
+		if desc.Lanes > c.lanes {
+			c.lanes = desc.Lanes
+		}
+	}
+
+	return c.prepareLanes(c.shards())
+}
+
+// prepareLanes 创建所有优先级的分片，消费组由消费者创建。只有自定义消费组的队列中不会留下没有消费者的默认消费组，
+// 所有消费组都确认后消息就会删除
+func (c *client) prepareLanes(shards int) error {
+	for lane := 0; lane < c.lanes; lane++ {
+		if err := c.driver.Prepare(c.laneQueue(lane), shards, ""); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (c *client) createShard(stream string, group string) error {
-	xinfo := redis.NewCmd("XINFO", "STREAM", stream)
+// laneQueue 优先级 lane 的分片在后端使用的队列名
+func (c *client) laneQueue(lane int) string {
+	return makeLaneName(c.streamName, lane)
+}
 
-	err := c.redisClient.Process(xinfo)
-	if err != nil {
-		xgroup := redis.NewCmd("XGROUP", "CREATE", stream, group, "$", "MKSTREAM")
+// streamOf 优先级 lane 的分片在 Redis 中的 key
+func (c *client) streamOf(lane int, shard int) string {
+	return makeStreamName(c.laneQueue(lane), c.tags.get(shard), shard)
+}
+
+// delayedOf 优先级 lane 的分片的延迟消息在 Redis 中的 key
+func (c *client) delayedOf(lane int, shard int) string {
+	return makeDelayedName(c.laneQueue(lane), c.tags.get(shard), shard)
+}
+
+// shards 当前的分片数量
+func (c *client) shards() int {
+	return int(atomic.LoadInt32(&c.shardsCount))
+}
+
+// watchShards 定期读取队列描述，分片数量增加后调用 grow，优先级增加时通过 emitter 提示
+func (c *client) watchShards(period time.Duration, done <-chan struct{}, emitter ErrorNotifier, grow func(from, to int)) {
+	tick := time.NewTicker(period)
+	defer tick.Stop()
+
+	lanes := c.lanes
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+		}
 
-		err := c.redisClient.Process(xgroup)
+		desc, err := ReadDescriptor(c.redisClient, c.streamName)
 		if err != nil {
-			return err
+			if emitter != nil {
+				emitter.EmitError(err)
+			}
+
+			continue
 		}
-	}
 
-	// Check after creation
-	err = c.redisClient.Process(xinfo)
-	if err != nil {
-		return err
-	}
+		// 优先级的数量在创建时确定，之后增加的优先级只提示
+		if desc.Lanes > lanes {
+			lanes = desc.Lanes
+			if emitter != nil {
+				emitter.EmitError(fmt.Errorf("%w: %v has %v, got %v", ErrLanesGrown, c.streamName, desc.Lanes, c.lanes))
+			}
+		}
 
-	return nil
+		// 先创建新的分片再更新分片数量。Reshard 已经在新的分片上创建了当时所有的消费组，
+		// 之后才创建的消费组由 grow 创建
+		from := c.shards()
+		if desc.Shards > from {
+			c.tags.set(desc.Tags)
+			grow(from, desc.Shards)
+			atomic.StoreInt32(&c.shardsCount, int32(desc.Shards))
+		}
+	}
 }
@@ -0,0 +1,213 @@
+package disruptor_test
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/sinuxlee/tile/pkg/disruptor"
+	"github.com/sinuxlee/tile/pkg/disruptor/disruptortest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloseFlushes(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: "flush", ShardsCount: 1, PipePeriod: time.Minute}, cli)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, pr.Push(pr.Value(&order{Seq: i})))
+	}
+
+	// 关闭时等待缓冲中的消息发送完成
+	dropped, err := pr.CloseContext(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, dropped)
+
+	info, err := disruptor.Inspect(cli, "flush", "", 0)
+	require.NoError(t, err)
+	assert.EqualValues(t, 10, info.Length)
+
+	assert.Equal(t, disruptor.ErrClosed, pr.Push(pr.Value(&order{})))
+	assert.Equal(t, disruptor.ErrClosed, pr.TryPush(pr.Value(&order{})))
+}
+
+func TestCloseDeadline(t *testing.T) {
+	mr, cli := disruptortest.NewRedis(t)
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: "deadline", ShardsCount: 1, PipePeriod: 5 * time.Millisecond}, cli)
+	require.NoError(t, err)
+
+	// Redis 不可用时一直重试，超过关闭的期限后放弃并返回丢失的消息数
+	mr.SetError("LOADING Redis is loading the dataset in memory")
+	for i := 0; i < 10; i++ {
+		require.NoError(t, pr.Push(pr.Value(&order{Seq: i})))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	dropped, err := pr.CloseContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 10, dropped)
+	assert.Less(t, int64(time.Since(started)), int64(time.Second))
+	mr.SetError("")
+}
+
+func TestCloseSpill(t *testing.T) {
+	mr, cli := disruptortest.NewRedis(t)
+	dir := t.TempDir()
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{
+		QueueName: "spilled", ShardsCount: 1, PipePeriod: 5 * time.Millisecond, SpillDir: dir, SpillPeriod: 10 * time.Millisecond,
+	}, cli)
+	require.NoError(t, err)
+
+	// Redis 不可用时消息写入段文件，不计入丢失的消息
+	mr.SetError("LOADING Redis is loading the dataset in memory")
+	var spilled int32
+	for i := 0; i < 10; i++ {
+		require.NoError(t, pr.PushConfirm(pr.Value(&order{Seq: i}), func(id string, err error) {
+			if err == disruptor.ErrSpilled {
+				atomic.AddInt32(&spilled, 1)
+			}
+		}))
+	}
+
+	dropped, err := pr.CloseContext(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, dropped)
+	assert.EqualValues(t, 10, atomic.LoadInt32(&spilled))
+
+	// 下次启动时重新发送
+	mr.SetError("")
+	pr, err = disruptor.NewProducer(&disruptor.ProducerOptions{
+		QueueName: "spilled", ShardsCount: 1, PipePeriod: 5 * time.Millisecond, SpillDir: dir, SpillPeriod: 10 * time.Millisecond,
+	}, cli)
+	require.NoError(t, err)
+	defer pr.Close()
+
+	assert.Eventually(t, func() bool {
+		info, err := disruptor.Inspect(cli, "spilled", "", 0)
+		return err == nil && info.Length == 10
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestConsumerCloseWaitsHandler(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: "inflight", ShardsCount: 1, PipePeriod: 5 * time.Millisecond}, cli)
+	require.NoError(t, err)
+	defer pr.Close()
+	_, err = pr.PushSync(context.Background(), pr.Value(&order{Seq: 1}))
+	require.NoError(t, err)
+
+	cn, err := disruptor.NewConsumer(&disruptor.ConsumerOptions{
+		QueueName: "inflight", Consumer: "c1", ShardsCount: 1, Block: 10 * time.Millisecond, PipePeriod: 5 * time.Millisecond,
+	}, cli)
+	require.NoError(t, err)
+
+	started := make(chan struct{})
+	var finished int32
+	go func() {
+		_ = popTimeout(cn, func(m disruptor.Message) error {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+			atomic.StoreInt32(&finished, 1)
+			return nil
+		})
+	}()
+
+	// 关闭时等待正在处理的消息完成并 ack
+	<-started
+	cn.Close()
+	assert.EqualValues(t, 1, atomic.LoadInt32(&finished))
+
+	info, err := disruptor.Inspect(cli, "inflight", "", 0)
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, info.Pending)
+}
+
+// blackHole 让 XADD 一直阻塞到测试结束，模拟没有响应的 Redis
+func blackHole(t *testing.T, cli redis.UniversalClient) <-chan struct{} {
+	entered, release := make(chan struct{}), make(chan struct{})
+	t.Cleanup(func() { close(release) })
+
+	once := sync.Once{}
+	cli.(*redis.Client).AddHook(cmdHook(func(cmd redis.Cmder) error {
+		if cmd.Name() == "xadd" {
+			once.Do(func() { close(entered) })
+			<-release
+		}
+		return nil
+	}))
+
+	return entered
+}
+
+func TestCloseDeadlineBlackHole(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: "blackhole", ShardsCount: 1, PipePeriod: 5 * time.Millisecond}, cli)
+	require.NoError(t, err)
+
+	// 正在进行的写入没有返回时，超过关闭的期限也不再等待
+	entered := blackHole(t, cli)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, pr.Push(pr.Value(&order{Seq: i})))
+	}
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	dropped, err := pr.CloseContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 10, dropped)
+	assert.Less(t, int64(time.Since(started)), int64(time.Second))
+}
+
+func TestCloseSpillBlackHole(t *testing.T) {
+	mr, cli := disruptortest.NewRedis(t)
+	dir := t.TempDir()
+	opt := func() *disruptor.ProducerOptions {
+		return &disruptor.ProducerOptions{
+			QueueName: "spill_blackhole", ShardsCount: 1, PipePeriod: 5 * time.Millisecond, SpillDir: dir, SpillPeriod: 10 * time.Millisecond,
+		}
+	}
+
+	// 上次运行时留下段文件
+	pr, err := disruptor.NewProducer(opt(), cli)
+	require.NoError(t, err)
+	mr.SetError("LOADING Redis is loading the dataset in memory")
+	require.NoError(t, pr.Push(pr.Value(&order{Seq: 1})))
+	pr.Close()
+	mr.SetError("")
+
+	// 重新发送段文件时没有响应，关闭时不等待它，也不再最后重新发送一次
+	entered := blackHole(t, cli)
+	pr, err = disruptor.NewProducer(opt(), cli)
+	require.NoError(t, err)
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	dropped, err := pr.CloseContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 0, dropped)
+	assert.Less(t, int64(time.Since(started)), int64(time.Second))
+
+	// 没有发送的消息留在段文件中
+	segs, err := filepath.Glob(filepath.Join(dir, "spill_blackhole", "[0-9]*"))
+	require.NoError(t, err)
+	assert.NotEmpty(t, segs)
+}
@@ -0,0 +1,189 @@
+package disruptor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/ugorji/go/codec"
+)
+
+// Codec 消息体的编解码方式，在 ProducerOptions 和 ConsumerOptions 中配置
+type Codec interface {
+	// Name 写入消息的 content-type 消息头
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// 内置的编解码方式
+var (
+	JSON       Codec = jsonCodec{}
+	MsgPack    Codec = msgpackCodec{}
+	Protobuf   Codec = protobufCodec{}
+	GzipJSON         = Gzip(JSON)
+	SnappyJSON       = Snappy(JSON)
+)
+
+var errNotProtoMessage = errors.New("disruptor: value is not a proto.Message")
+
+// Gzip 使用 gzip 压缩 c 的编码结果
+func Gzip(c Codec) Codec {
+	return &compressCodec{
+		Codec:      c,
+		name:       "gzip+" + c.Name(),
+		compress:   gzipCompress,
+		decompress: gzipDecompress,
+	}
+}
+
+// Snappy 使用 snappy 压缩 c 的编码结果，压缩率不如 gzip 但速度快很多
+func Snappy(c Codec) Codec {
+	return &compressCodec{
+		Codec: c,
+		name:  "snappy+" + c.Name(),
+		compress: func(data []byte) ([]byte, error) {
+			return snappy.Encode(nil, data), nil
+		},
+		decompress: func(data []byte) ([]byte, error) {
+			return snappy.Decode(nil, data)
+		},
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+var msgpackHandle = &codec.MsgpackHandle{}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var data []byte
+	err := codec.NewEncoderBytes(&data, msgpackHandle).Encode(v)
+	return data, err
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return codec.NewDecoderBytes(data, msgpackHandle).Decode(v)
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string {
+	return "protobuf"
+}
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, errNotProtoMessage
+	}
+
+	return proto.Marshal(m)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return errNotProtoMessage
+	}
+
+	return proto.Unmarshal(data, m)
+}
+
+// compressCodec 在另一个 Codec 的基础上压缩
+type compressCodec struct {
+	Codec
+	name       string
+	compress   func([]byte) ([]byte, error)
+	decompress func([]byte) ([]byte, error)
+}
+
+func (c *compressCodec) Name() string {
+	return c.name
+}
+
+func (c *compressCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := c.Codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.compress(data)
+}
+
+func (c *compressCodec) Unmarshal(data []byte, v interface{}) error {
+	data, err := c.decompress(data)
+	if err != nil {
+		return err
+	}
+
+	return c.Codec.Unmarshal(data, v)
+}
+
+func gzipCompress(data []byte) ([]byte, error) {
+	buff := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(buff)
+	if _, err := gzipWriter.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := gzipWriter.Close(); err != nil {
+		return nil, err
+	}
+
+	return buff.Bytes(), nil
+}
+
+func gzipDecompress(compress []byte) ([]byte, error) {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(compress))
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(gzipReader)
+	if err != nil {
+		return nil, err
+	}
+
+	err = gzipReader.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// codecValue 使用队列配置的 Codec 编解码的普通结构体
+type codecValue struct {
+	codec Codec
+	v     interface{}
+}
+
+func (c *codecValue) Marshal() ([]byte, error) {
+	return c.codec.Marshal(c.v)
+}
+
+func (c *codecValue) Unmarshal(data []byte) error {
+	return c.codec.Unmarshal(data, c.v)
+}
@@ -0,0 +1,29 @@
+package disruptor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type codecPlayer struct {
+	UserID   int    `json:"userId" codec:"userId"`
+	NickName string `json:"nickName" codec:"nickName"`
+}
+
+func TestCodecs(t *testing.T) {
+	codecs := []Codec{JSON, MsgPack, GzipJSON, SnappyJSON, Gzip(MsgPack)}
+	for _, c := range codecs {
+		in := &codecPlayer{UserID: 131198216, NickName: "robot_1"}
+		data, err := c.Marshal(in)
+		assert.NoErrorf(t, err, "%v marshal failed", c.Name())
+
+		out := &codecPlayer{}
+		err = c.Unmarshal(data, out)
+		assert.NoErrorf(t, err, "%v unmarshal failed", c.Name())
+		assert.Equalf(t, in, out, "%v round trip mismatch", c.Name())
+	}
+
+	_, err := Protobuf.Marshal(&codecPlayer{})
+	assert.Errorf(t, err, "protobuf should reject non proto message")
+}
@@ -1,8 +1,10 @@
 package disruptor
 
 import (
+	"context"
 	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v7"
@@ -12,34 +14,75 @@ import (
 
 var defaultConsumerOptions = ConsumerOptions{
 	ShardsCount:       10,                     // 分片队列的个数
+	WatchPeriod:       10 * time.Second,       // 检查分片数量变化的时间间隔
 	PrefetchCount:     100,                    // 每次从分片队列取消息的个数
 	PendingBufferSize: 1000,                   // 本地消息缓存队列大小，需要 >= ShardsCount*PrefetchCount
 	PipeBufferSize:    100,                    // 每个分片队列 ack pipeline 的个数
 	PipePeriod:        100 * time.Millisecond, // ack分片队列等待的最长时间
+	ClaimPeriod:       30 * time.Second,       // 检查可回收消息的时间间隔
+	Codec:             JSON,                   // Value 的解码方式
+	Priorities:        1,                      // 默认没有优先级
+	Naming:            SlotNaming{},           // 分片的 hash tag 按集群的 master 分配
+	FlowPeriod:        time.Second,            // 统计处理速度的时间间隔
+	DelayPeriod:       time.Second,            // 检查到期延迟消息的时间间隔
+	DedupLock:         time.Minute,            // 去重时消息处理中标记的有效期
+	Metrics:           nopMetrics{},
+	Retry: RetryPolicy{
+		MaxAttempts: 1,                      // 默认不重试
+		Backoff:     100 * time.Millisecond, // 第一次重试前等待的时长
+		MaxBackoff:  5 * time.Second,        // 重试等待的最长时间
+	},
 }
 
 type ConsumerOptions struct {
 	QueueName         string
 	Consumer          string
-	ShardsCount       int8
-	PrefetchCount     int64         // 每次从队列中读取的消息数量
+	Group             string        // 消费组名称，为空时使用队列默认的消费组。不同的消费组各自收到全部消息，所有消费组都确认后消息才删除，不再消费的消费组需要删除，否则队列只能由 MaxLen 或 MaxAge 裁剪
+	ShardsCount       int8          // 第一次创建队列时的分片数量，之后以 Redis 中的队列描述为准
+	PrefetchCount     int64         // 每次从队列中读取的消息数量，自适应时为上限
+	AdaptivePrefetch  bool          // 按处理速度和本地缓冲中的消息数调整每次读取的数量，缓冲中的消息够处理一个 FlowPeriod 时暂停读取
+	HighWaterMark     int64         // 本地缓冲中的消息数达到该值时暂停读取，降到一半以下后恢复，为0时不暂停
+	FlowPeriod        time.Duration // 统计处理速度和调整读取数量的时间间隔
 	Block             time.Duration // 读取队列数据时阻塞的时长
 	PendingBufferSize int64         // 本地缓冲队列长度
 	PipeBufferSize    int64         // 每次批量ack的数量
 	PipePeriod        time.Duration // 每次ack的时间间隔
+	Retry             RetryPolicy   // 处理失败时的重试策略
+	DeadLetter        bool          // 最终处理失败的消息是否写入死信队列，失败原因和处理次数记录在 HeaderError 等消息头中
+	ClaimMinIdle      time.Duration // 回收空闲超过该时长的消息，包括自己没有 ack 也不再持有的消息，为0时不回收
+	ClaimPeriod       time.Duration // 检查可回收消息的时间间隔
+	Codec             Codec         // Value 的解码方式
+	DedupWindow       time.Duration // 处理过的消息在该时长内不会重复处理，为0时不去重，ClaimMinIdle 为0时使用 DedupLock
+	DedupLock         time.Duration // 消息处理中标记的有效期，需要大于处理一条消息的最长时间
+	KeepAcked         bool          // ack 后不删除消息，由生产者的 MaxLen 或 MaxAge 裁剪，保留的消息可以通过 Replay 重新处理。有多个消费组时所有消费组的消费者都需要设置
+	WatchPeriod       time.Duration // 检查分片数量变化的时间间隔
+	DelayPeriod       time.Duration // 转移到期的延迟消息的时间间隔
+	MoveDelayed       bool          // 是否转移到期的延迟消息，写入延迟消息的生产者都关闭后到期的消息也会被消费，队列使用 PushAt 时需要设置
+	Driver            Driver        // 队列的存储后端，为空时使用 Redis Streams
+	Priorities        int           // 优先级的数量，队列描述中记录了更多的优先级时以队列描述为准
+	PriorityWeights   []int         // 各个优先级都有消息时每轮最多处理的消息数，下标为优先级，为空时优先级 p 的权重为 4^p
+	Naming            Naming        // 第一次创建队列时选择分片的 hash tag，之后以 Redis 中的队列描述为准
 	ErrorNotifier     ErrorNotifier
+	ClaimNotifier     ClaimNotifier
+	Metrics           Metrics
 }
 
 type consumer struct {
 	*client
 	*ConsumerOptions
-	ackChan     chan Message
-	msgChan     chan Message
-	stopped     bool
-	isConsuming bool
-	emitter     ErrorNotifier
-	wgAck       *sync.WaitGroup
-	wgCons      *sync.WaitGroup
+	ackChan  chan Message
+	msgChan  chan Message
+	done     chan struct{}
+	stopped  bool
+	emitter  ErrorNotifier
+	wgAck    *sync.WaitGroup
+	wgCons   *sync.WaitGroup
+	inflight *sync.WaitGroup // 已放入本地缓冲但还没有处理完的消息
+	held     sync.Map        // 本地缓冲中和正在处理的消息，回收时跳过
+
+	laneChans []chan Message // 各个优先级的本地缓冲，只有一个优先级时为空，消息直接放入 msgChan
+	wake      chan struct{}  // 有新消息放入 laneChans
+	flow      flowControl
 }
 
 func NewConsumer(opt *ConsumerOptions, rdsCli redis.UniversalClient) (Consumer, error) {
@@ -47,12 +90,31 @@ func NewConsumer(opt *ConsumerOptions, rdsCli redis.UniversalClient) (Consumer,
 		return nil, err
 	}
 
-	cli, err := newClient(opt.QueueName, opt.ShardsCount, rdsCli)
+	if opt.Group == "" {
+		opt.Group = makeGroupName(opt.QueueName)
+	}
+
+	// 去重时正在被其他消费者处理的消息留在 PEL 中，需要回收协程在标记过期后重新投递
+	if opt.DedupWindow > 0 && opt.ClaimMinIdle <= 0 {
+		opt.ClaimMinIdle = opt.DedupLock
+	}
+
+	driver, rdsCli := selectDriver(opt.Driver, &redisDriver{cli: rdsCli, keepAcked: opt.KeepAcked})
+	if rdsCli == nil && (opt.DeadLetter || opt.DedupWindow > 0 || opt.MoveDelayed) {
+		return nil, ErrNotSupported
+	}
+
+	cli, err := newClient(opt.QueueName, opt.ShardsCount, opt.Codec.Name(), opt.Priorities, opt.Naming, rdsCli, driver)
 	if err != nil {
 		return nil, err
 	}
 
+	// 有多个优先级时消息先放入各自的缓冲，处理时再按优先级选择
 	msgChan := make(chan Message, opt.PendingBufferSize)
+	if cli.lanes > 1 {
+		msgChan = make(chan Message)
+	}
+
 	ackChan := make(chan Message, opt.PendingBufferSize)
 	cn := &consumer{
 		ackChan:         ackChan,
@@ -62,7 +124,23 @@ func NewConsumer(opt *ConsumerOptions, rdsCli redis.UniversalClient) (Consumer,
 		ConsumerOptions: opt,
 		wgAck:           &sync.WaitGroup{},
 		wgCons:          &sync.WaitGroup{},
-		isConsuming:     true,
+		inflight:        &sync.WaitGroup{},
+		done:            make(chan struct{}),
+		flow:            flowControl{limit: opt.PrefetchCount},
+	}
+
+	if cli.lanes > 1 {
+		cn.laneChans = make([]chan Message, cli.lanes)
+		for i := range cn.laneChans {
+			cn.laneChans[i] = make(chan Message, opt.PendingBufferSize)
+		}
+
+		cn.wake = make(chan struct{}, 1)
+	}
+
+	// 生产者不创建消费组，默认消费组和自定义的消费组都由消费者在每个分片上按需创建
+	if err := cn.prepare(cli.shards()); err != nil {
+		return nil, err
 	}
 
 	cn.wgAck.Add(1)
@@ -74,45 +152,163 @@ func NewConsumer(opt *ConsumerOptions, rdsCli redis.UniversalClient) (Consumer,
 }
 
 func (c *consumer) start() {
-	for i := 0; i < int(c.ShardsCount); i++ {
+	for lane := 0; lane < c.lanes; lane++ {
+		for _, shards := range c.shardGroups(0, c.shards()) {
+			c.wgCons.Add(1)
+			go c.consume(lane, shards)
+		}
+	}
+
+	if c.laneChans != nil {
+		c.wgCons.Add(1)
+		go c.dispatch()
+	}
+
+	if c.AdaptivePrefetch {
+		c.wgCons.Add(1)
+		go c.regulate()
+	}
+
+	if c.redisClient != nil {
+		c.wgCons.Add(1)
+		go func() {
+			c.watchShards(c.WatchPeriod, c.done, c.emitter, c.grow)
+			c.wgCons.Done()
+		}()
+	}
+
+	if c.MoveDelayed {
+		c.wgCons.Add(1)
+		go func() {
+			c.moveDelayed(c.DelayPeriod, c.PrefetchCount, 0, c.done, c.emitter)
+			c.wgCons.Done()
+		}()
+	}
+
+	if c.ClaimMinIdle > 0 {
 		c.wgCons.Add(1)
-		go c.consume(i)
+		go c.reclaim()
 	}
 }
 
-func (c *consumer) Pop(data Marshaler, h Handler) (error, bool) {
-	m, more := <-c.msgChan
-	if !more {
-		return nil, more
+// prepare 在所有优先级的分片上创建消费组
+func (c *consumer) prepare(shards int) error {
+	for lane := 0; lane < c.lanes; lane++ {
+		if err := c.driver.Prepare(c.laneQueue(lane), shards, c.groupOf(lane)); err != nil {
+			return err
+		}
 	}
 
-	defer c.ack(m)
+	return nil
+}
 
-	err := data.Unmarshal(m.Body)
-	if err != nil {
-		return err, more
+// groupOf 优先级 lane 使用的消费组
+func (c *consumer) groupOf(lane int) string {
+	return makeLaneGroup(c.QueueName, c.Group, lane)
+}
+
+// grow 重新分片后开始消费新的分片，原来的分片继续消费
+func (c *consumer) grow(from, to int) {
+	if err := c.prepare(to); err != nil && c.emitter != nil {
+		c.emitter.EmitError(err)
+	}
+
+	for lane := 0; lane < c.lanes; lane++ {
+		for _, shards := range c.shardGroups(from, to) {
+			c.wgCons.Add(1)
+			go c.consume(lane, shards)
+		}
+	}
+}
+
+// shardGroups 把分片 from 到 to-1 按 hash tag 分组，同一组的分片位于同一个节点，一次读取。
+// 后端不能一次读取多个分片时每个分片单独一组
+func (c *consumer) shardGroups(from, to int) [][]int {
+	_, batch := c.driver.(BatchReader)
+
+	var groups [][]int
+	index := make(map[string]int)
+	for i := from; i < to; i++ {
+		if !batch {
+			groups = append(groups, []int{i})
+			continue
+		}
+
+		slot := c.tags.slot(i)
+		g, ok := index[slot]
+		if !ok {
+			g = len(groups)
+			index[slot] = g
+			groups = append(groups, nil)
+		}
+
+		groups[g] = append(groups[g], i)
+	}
+
+	return groups
+}
+
+func (c *consumer) Pop(data Marshaler, h Handler) (error, bool) {
+	return c.PopContext(context.Background(), data, h)
+}
+
+func (c *consumer) PopContext(ctx context.Context, data Marshaler, h Handler) (error, bool) {
+	return popMessage(ctx, c.msgChan, data, h, c.handle)
+}
+
+// popMessage 等待 msgChan 中的一条消息交给 handle 解码和处理，返回处理的错误。
+// msgChan 关闭时返回 false，ctx 先结束时返回 ctx.Err()，消息留在 msgChan 中
+func popMessage(ctx context.Context, msgChan <-chan Message, data Marshaler, h Handler,
+	handle func(m Message, data Marshaler, h Handler) error) (error, bool) {
+	select {
+	case m, more := <-msgChan:
+		if !more {
+			return nil, more
+		}
+
+		return handle(m, data, h), more
+	case <-ctx.Done():
+		return ctx.Err(), true
 	}
+}
 
-	return h(m), more
+func (c *consumer) Value(v interface{}) Marshaler {
+	return &codecValue{codec: c.Codec, v: v}
 }
 
 func (c *consumer) Close() {
-	c.isConsuming = false
+	close(c.done)
 
 	c.wgCons.Wait()
+	for _, ch := range c.laneChans {
+		for len(ch) != 0 {
+			c.release(<-ch)
+		}
+	}
+
 	close(c.msgChan)
+
+	// 丢弃还没有开始处理的消息，它们留在 PEL 中等待重新投递，然后等待正在处理的消息完成
+	for m := range c.msgChan {
+		c.release(m)
+	}
+	c.inflight.Wait()
 	c.stopped = true
 
 	close(c.ackChan)
 	c.wgAck.Wait()
-}
 
-func (c *consumer) consume(shard int) {
-	group := makeGroupName(c.QueueName)
-	stream := makeStreamName(c.QueueName, shard)
+	// 没有 ack 的消息由后端重新投递，本地为它们保存的状态不再需要
+	if cc, ok := c.driver.(ConsumerCloser); ok {
+		for lane := 0; lane < c.lanes; lane++ {
+			cc.CloseConsumer(c.laneQueue(lane), c.groupOf(lane), c.Consumer)
+		}
+	}
+}
 
-	lastID := "0-0"
-	checkBacklog := true
+// consume 读取一组分片，每个分片先读取积压的消息，之后读取新的消息
+func (c *consumer) consume(lane int, shards []int) {
+	group := c.groupOf(lane)
 
 	// Millisecond is minimal for Redis
 	block := time.Second * 1
@@ -120,27 +316,39 @@ func (c *consumer) consume(shard int) {
 		block = c.Block
 	}
 
-	for c.isConsuming {
-		var id string
-		if checkBacklog {
-			id = lastID
-		} else {
-			id = ">"
+	args := make([]*ReadArgs, len(shards))
+	streams := make([]string, len(shards))
+	for i, shard := range shards {
+		args[i] = &ReadArgs{
+			Queue:    c.laneQueue(lane),
+			Shard:    shard,
+			Group:    group,
+			Consumer: c.Consumer,
+			Block:    block,
+			Backlog:  true,
+		}
+
+		streams[i] = c.streamOf(lane, shard)
+	}
+
+	for c.isConsuming() {
+		// 本地缓冲中的消息太多时暂停读取，避免读取的消息长时间留在 PEL 中
+		if !c.waitLowWater() {
+			break
+		}
+
+		count := c.prefetch()
+		for _, a := range args {
+			a.Count = count
 		}
 
-		var res []redis.XStream
+		var res [][]Record
 		err := repeat.Repeat(
 			repeat.Fn(func() error {
 				var err error
-				res, err = c.redisClient.XReadGroup(&redis.XReadGroupArgs{
-					Block:    block,
-					Consumer: c.Consumer,
-					Count:    c.PrefetchCount,
-					Group:    group,
-					Streams:  []string{stream, id},
-				}).Result()
-
-				if err != nil && err != redis.Nil {
+				res, err = c.read(args)
+
+				if err != nil {
 					if c.emitter != nil {
 						c.emitter.EmitError(err)
 					}
@@ -162,42 +370,94 @@ func (c *consumer) consume(shard int) {
 			continue
 		}
 
-		if checkBacklog && (len(res) == 0 || len(res[0].Messages) == 0) {
-			checkBacklog = false
-			continue
+		for i, a := range args {
+			if a.Backlog && len(res[i]) == 0 {
+				a.Backlog = false
+				continue
+			}
+
+			c.Metrics.Received(c.QueueName, lane, a.Shard, len(res[i]))
+			for _, r := range res[i] {
+				a.After = r.ID
+				c.deliver(lane, a.Shard, streams[i], group, r)
+			}
 		}
+	}
 
-		for _, s := range res {
-			for _, m := range s.Messages {
-				lastID = m.ID
+	c.wgCons.Done()
+}
 
-				msg := Message{
-					Group:  group,
-					ID:     m.ID,
-					Stream: stream,
-				}
+// read 读取 args 中的所有分片，多个分片时后端一定实现了 BatchReader
+func (c *consumer) read(args []*ReadArgs) ([][]Record, error) {
+	if len(args) > 1 {
+		return c.driver.(BatchReader).ReadGroups(args)
+	}
 
-				v, exist := m.Values[dataField]
-				data, ok := v.(string)
-				if !exist || !ok {
-					if c.emitter != nil {
-						c.emitter.EmitError(errors.New("Incorrect message format: no \"data\" field in message with id " + m.ID))
-					}
+	res, err := c.driver.ReadGroup(args[0])
+	if err != nil {
+		return nil, err
+	}
 
-					c.ack(msg)
-					continue
-				}
+	return [][]Record{res}, nil
+}
 
-				msg.Body = []byte(data)
-				c.msgChan <- msg
-			}
+func (c *consumer) isConsuming() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// deliver 把读取到的消息放入本地缓冲，格式错误的消息直接ack
+func (c *consumer) deliver(lane int, shard int, stream string, group string, r Record) {
+	msg := Message{
+		Group:   group,
+		ID:      r.ID,
+		Stream:  stream,
+		Body:    r.Body,
+		Headers: r.Headers,
+		shard:   shard,
+		lane:    lane,
+	}
+
+	if r.Body == nil {
+		if c.emitter != nil {
+			c.emitter.EmitError(errors.New("Incorrect message format: no \"data\" field in message with id " + r.ID))
 		}
+
+		c.ack(msg)
+		return
 	}
 
-	c.wgCons.Done()
+	ch := c.msgChan
+	if c.laneChans != nil {
+		ch = c.laneChans[lane]
+	}
+
+	// 积压读取和回收可能拿到同一条消息，本地已经有的不再重复放入
+	if !c.hold(msg) {
+		return
+	}
+
+	select {
+	case ch <- msg:
+		if c.wake != nil {
+			select {
+			case c.wake <- struct{}{}:
+			default:
+			}
+		}
+	case <-c.done:
+		// 正在关闭，消息留在 PEL 中等待重新投递
+		c.release(msg)
+	}
 }
 
 func (c *consumer) ack(m Message) {
+	atomic.AddInt64(&c.flow.handled, 1)
+	c.held.Store(heldKey(m.Stream, m.ID), true)
 	c.ackChan <- m
 }
 
@@ -230,6 +490,8 @@ func (c *consumer) processAck() {
 				cnt[stream]++
 			}
 		case <-tick.C:
+			c.Metrics.BufferDepth(c.QueueName, BufferConsumer, int(c.buffered()))
+			c.Metrics.BufferDepth(c.QueueName, BufferAck, len(c.ackChan))
 		}
 
 		if doStop {
@@ -266,23 +528,21 @@ func (c *consumer) sendAckStreamWithLock(lst []Message) {
 		ids[i] = m.ID
 	}
 
+	// lst 的底层数组会被下一批复用，在启动 goroutine 前取出需要的字段
+	lane, shard, stream, group := lst[0].lane, lst[0].shard, lst[0].Stream, lst[0].Group
 	c.wgAck.Add(1)
 
 	go func() {
-		c.sendAckStream(lst[0].Stream, lst[0].Group, ids)
+		c.sendAckStream(lane, shard, stream, group, ids)
 		c.wgAck.Done()
 	}()
 }
 
-func (c *consumer) sendAckStream(stream string, group string, ids []string) {
+func (c *consumer) sendAckStream(lane int, shard int, stream string, group string, ids []string) {
 	err := repeat.Repeat(
 		repeat.Fn(func() error {
-			pipe := c.redisClient.TxPipeline()
-
-			pipe.XAck(stream, group, ids...)
-			pipe.XDel(stream, ids...)
-
-			_, err := pipe.Exec()
+			started := time.Now()
+			err := c.driver.Ack(c.laneQueue(lane), shard, group, ids)
 
 			if err != nil {
 				if c.emitter != nil {
@@ -292,13 +552,21 @@ func (c *consumer) sendAckStream(stream string, group string, ids []string) {
 				return repeat.HintTemporary(err)
 			}
 
+			c.Metrics.Acked(c.QueueName, lane, shard, len(ids), time.Since(started))
 			return nil
 		}),
 		repeat.StopOnSuccess(),
 		repeat.WithDelay(repeat.FullJitterBackoff(500*time.Millisecond).Set()),
 	)
 
-	if err != nil && c.emitter != nil {
-		c.emitter.EmitError(err)
+	if err != nil {
+		c.Metrics.AckFailed(c.QueueName, lane, shard, len(ids))
+		if c.emitter != nil {
+			c.emitter.EmitError(err)
+		}
+	}
+
+	for _, id := range ids {
+		c.held.Delete(heldKey(stream, id))
 	}
 }
@@ -0,0 +1,73 @@
+package disruptor_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sinuxlee/tile/pkg/disruptor"
+	"github.com/sinuxlee/tile/pkg/disruptor/disruptortest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushBufferFull(t *testing.T) {
+	mr, cli := disruptortest.NewRedis(t)
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{
+		QueueName: "full", ShardsCount: 1, PendingBufferSize: 1, PipeBufferSize: 1, PipePeriod: 5 * time.Millisecond,
+	}, cli)
+	require.NoError(t, err)
+
+	// Redis 不可用时发送协程一直重试，本地缓冲很快写满
+	mr.SetError("LOADING Redis is loading the dataset in memory")
+	defer mr.SetError("")
+
+	full := false
+	for i := 0; i < 100 && !full; i++ {
+		err := pr.TryPush(pr.Value(&order{Seq: i}))
+		if err == disruptor.ErrBufferFull {
+			full = true
+			continue
+		}
+
+		require.NoError(t, err)
+		time.Sleep(time.Millisecond)
+	}
+	require.True(t, full)
+
+	// 缓冲已满时 PushContext 等待到 ctx 结束
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	assert.Equal(t, context.DeadlineExceeded, pr.PushContext(ctx, pr.Value(&order{})))
+	assert.GreaterOrEqual(t, int64(time.Since(started)), int64(50*time.Millisecond))
+
+	closeCtx, closeCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer closeCancel()
+	_, _ = pr.CloseContext(closeCtx)
+}
+
+func TestPopContextDeadline(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+
+	cn, err := disruptor.NewConsumer(&disruptor.ConsumerOptions{
+		QueueName: "empty", Consumer: "c1", ShardsCount: 1, Block: 10 * time.Millisecond, PipePeriod: 5 * time.Millisecond,
+	}, cli)
+	require.NoError(t, err)
+	defer cn.Close()
+
+	// 没有消息时等待到 ctx 结束，消费者没有关闭
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	err, more := cn.PopContext(ctx, cn.Value(&order{}), func(m disruptor.Message) error {
+		t.Fatal("unexpected message")
+		return nil
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, more)
+	assert.GreaterOrEqual(t, int64(time.Since(started)), int64(50*time.Millisecond))
+}
@@ -0,0 +1,69 @@
+package disruptor
+
+import (
+	"fmt"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// 去重标记的状态
+const (
+	dedupProcessing = "processing"
+	dedupDone       = "done"
+)
+
+func (c *consumer) dedupKey(m Message) string {
+	id := m.Headers.Get(HeaderMessageID)
+	if id == "" {
+		// 没有生产者分配的id时使用队列中的id，只能识别同一条消息的重复投递
+		id = m.Stream + "/" + m.ID
+	}
+
+	return fmt.Sprintf("disruptor:%v:dedup:%v:%v", c.QueueName, m.Group, id)
+}
+
+// dedupBegin 标记消息正在处理，返回 false 表示消息已经处理过或者正在被其他消费者处理。
+// 已经处理过的消息直接ack，正在处理的消息和出错时的消息留在 PEL 中，空闲超过 ClaimMinIdle 后由回收协程重新投递
+func (c *consumer) dedupBegin(m Message) (bool, error) {
+	key := c.dedupKey(m)
+	for {
+		ok, err := c.redisClient.SetNX(key, dedupProcessing, c.DedupLock).Result()
+		if err != nil || ok {
+			return ok, err
+		}
+
+		state, err := c.redisClient.Get(key).Result()
+		if err == redis.Nil {
+			// 标记在 SETNX 和 GET 之间过期，重新标记
+			continue
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		if state == dedupDone {
+			c.ack(m)
+		}
+
+		return false, nil
+	}
+}
+
+// dedupEnd 处理完成的消息在去重窗口内不会再处理，没有完成的消息清除标记等待重新投递
+func (c *consumer) dedupEnd(m Message, done bool) {
+	if c.DedupWindow <= 0 {
+		return
+	}
+
+	var err error
+	if done {
+		err = c.redisClient.Set(c.dedupKey(m), dedupDone, c.DedupWindow).Err()
+	} else {
+		err = c.redisClient.Del(c.dedupKey(m)).Err()
+	}
+
+	if err != nil && c.emitter != nil {
+		c.emitter.EmitError(err)
+	}
+}
@@ -0,0 +1,198 @@
+package disruptor_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/sinuxlee/tile/pkg/disruptor"
+	"github.com/sinuxlee/tile/pkg/disruptor/disruptortest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cmdHook 在命令发送前调用，返回错误时命令失败
+type cmdHook func(cmd redis.Cmder) error
+
+func (h cmdHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, h(cmd)
+}
+
+func (h cmdHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (h cmdHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	for _, cmd := range cmds {
+		if err := h(cmd); err != nil {
+			return ctx, err
+		}
+	}
+
+	return ctx, nil
+}
+
+func (h cmdHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+// dedupCmd 命令操作的去重标记，不是去重标记的命令返回空
+func dedupCmd(cmd redis.Cmder) string {
+	if args := cmd.Args(); len(args) > 1 {
+		if key, ok := args[1].(string); ok && strings.Contains(key, ":dedup:") {
+			return key
+		}
+	}
+
+	return ""
+}
+
+func dedupQueue(t *testing.T, cli redis.UniversalClient, queue string, opt *disruptor.ConsumerOptions) disruptor.Consumer {
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: queue, ShardsCount: 1, PipePeriod: 5 * time.Millisecond}, cli)
+	require.NoError(t, err)
+	require.NoError(t, pr.Push(pr.Value(&order{Seq: 1})))
+	pr.Close()
+
+	opt.QueueName, opt.Consumer, opt.ShardsCount = queue, "c1", 1
+	opt.Block, opt.PipePeriod, opt.ClaimPeriod = 10*time.Millisecond, 5*time.Millisecond, 20*time.Millisecond
+	opt.DedupWindow, opt.DedupLock = time.Minute, 50*time.Millisecond
+	cn, err := disruptor.NewConsumer(opt, cli)
+	require.NoError(t, err)
+
+	return cn
+}
+
+func popTimeout(cn disruptor.Consumer, h disruptor.Handler) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	err, _ := cn.PopContext(ctx, cn.Value(&order{}), h)
+	return err
+}
+
+func TestDedupMarkExpired(t *testing.T) {
+	mr, cli := disruptortest.NewRedis(t)
+
+	// 第一次标记时已经有其他消费者的标记，读取标记前它过期了
+	marked := false
+	cli.(*redis.Client).AddHook(cmdHook(func(cmd redis.Cmder) error {
+		key := dedupCmd(cmd)
+		switch {
+		case key == "":
+		case cmd.Name() == "set" && !marked:
+			marked = true
+			mr.Set(key, "processing")
+		case cmd.Name() == "get":
+			mr.Del(key)
+		}
+		return nil
+	}))
+
+	cn := dedupQueue(t, cli, "dedup_expired", &disruptor.ConsumerOptions{})
+	defer cn.Close()
+
+	calls := 0
+	require.NoError(t, popTimeout(cn, func(m disruptor.Message) error {
+		calls++
+		return nil
+	}))
+	assert.Equal(t, 1, calls)
+}
+
+func TestDedupProcessingRedelivered(t *testing.T) {
+	mr, cli := disruptortest.NewRedis(t)
+
+	// 第一次投递时消息正在被其他消费者处理
+	key := ""
+	cli.(*redis.Client).AddHook(cmdHook(func(cmd redis.Cmder) error {
+		if k := dedupCmd(cmd); k != "" && cmd.Name() == "set" && key == "" {
+			key = k
+			mr.Set(k, "processing")
+		}
+		return nil
+	}))
+
+	cn := dedupQueue(t, cli, "dedup_processing", &disruptor.ConsumerOptions{})
+	defer cn.Close()
+
+	calls := 0
+	h := func(m disruptor.Message) error {
+		calls++
+		return nil
+	}
+
+	require.NoError(t, popTimeout(cn, h))
+	assert.Equal(t, 0, calls)
+
+	// 其他消费者的标记过期后，留在自己 PEL 中的消息被回收重新投递
+	mr.Del(key)
+	require.NoError(t, popTimeout(cn, h))
+	assert.Equal(t, 1, calls)
+}
+
+func TestDedupDeadLetterFailed(t *testing.T) {
+	mr, cli := disruptortest.NewRedis(t)
+
+	key, failed := "", false
+	cli.(*redis.Client).AddHook(cmdHook(func(cmd redis.Cmder) error {
+		if k := dedupCmd(cmd); k != "" && cmd.Name() == "set" {
+			key = k
+		}
+
+		if cmd.Name() == "xadd" && strings.HasSuffix(cmd.Args()[1].(string), ":dead") && !failed {
+			failed = true
+			return errors.New("dead letter unavailable")
+		}
+		return nil
+	}))
+
+	cn := dedupQueue(t, cli, "dedup_dead", &disruptor.ConsumerOptions{DeadLetter: true})
+	defer cn.Close()
+
+	calls := 0
+	h := func(m disruptor.Message) error {
+		calls++
+		if calls == 1 {
+			return errors.New("first attempt fails")
+		}
+		return nil
+	}
+
+	// 死信队列写入失败，清除标记，消息留在 PEL 中等待重新投递
+	assert.Error(t, popTimeout(cn, h))
+	assert.False(t, mr.Exists(key))
+
+	require.NoError(t, popTimeout(cn, h))
+	assert.Equal(t, 2, calls)
+}
+
+func TestDedupDoneRedelivered(t *testing.T) {
+	mr, cli := disruptortest.NewRedis(t)
+
+	// 其他消费者处理完成后在 XACK 之前崩溃，消息重新投递时标记已经是 done
+	cli.(*redis.Client).AddHook(cmdHook(func(cmd redis.Cmder) error {
+		if k := dedupCmd(cmd); k != "" && cmd.Name() == "set" {
+			mr.Set(k, "done")
+		}
+		return nil
+	}))
+
+	cn := dedupQueue(t, cli, "dedup_done", &disruptor.ConsumerOptions{})
+	defer cn.Close()
+
+	calls := 0
+	require.NoError(t, popTimeout(cn, func(m disruptor.Message) error {
+		calls++
+		return nil
+	}))
+	assert.Equal(t, 0, calls)
+
+	// 不再处理的消息直接 ack，PEL 清空，消息从分片中删除
+	assert.Eventually(t, func() bool {
+		info, err := disruptor.Inspect(cli, "dedup_done", "", 0)
+		return err == nil && info.Pending == 0 && info.Length == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
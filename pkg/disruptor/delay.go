@@ -0,0 +1,170 @@
+package disruptor
+
+import (
+	"crypto/rand"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// moveScript 把到期的延迟消息从有序集合转移到分片队列。
+// 有序集合和分片队列使用相同的 hash tag，脚本的原子性保证多个节点同时转移时每条消息只转移一次
+var moveScript = redis.NewScript(`
+local function decode(s)
+	local fields = {}
+	local pos = 1
+	while pos <= #s do
+		local sep = string.find(s, ':', pos, true)
+		local n = tonumber(string.sub(s, pos, sep - 1))
+		table.insert(fields, string.sub(s, sep + 1, sep + n))
+		pos = sep + n + 1
+	end
+	return fields
+end
+
+local items = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, item in ipairs(items) do
+	local fields = decode(item)
+	table.remove(fields, 1)
+	if tonumber(ARGV[3]) > 0 then
+		redis.call('XADD', KEYS[2], 'MAXLEN', '~', ARGV[3], '*', unpack(fields))
+	else
+		redis.call('XADD', KEYS[2], '*', unpack(fields))
+	end
+	redis.call('ZREM', KEYS[1], item)
+end
+return #items
+`)
+
+func (p *producer) PushAt(at time.Time, data Marshaler, opts ...PushOption) error {
+	if p.redisClient == nil {
+		return ErrNotSupported
+	}
+
+	m, err := p.newOutMessage(data, nil, opts)
+	if err != nil {
+		return err
+	}
+
+	ms := at.UnixNano() / int64(time.Millisecond)
+	WithHeader(HeaderDeliverAt, strconv.FormatInt(ms, 10))(m)
+
+	shard, err := p.delayShard(m)
+	if err != nil {
+		return err
+	}
+
+	member, err := encodeDelayed(m)
+	if err != nil {
+		return err
+	}
+
+	if err := p.acceptDelayed(); err != nil {
+		return err
+	}
+
+	return p.redisClient.ZAdd(p.delayedOf(m.lane, shard), &redis.Z{
+		Score:  float64(ms),
+		Member: member,
+	}).Err()
+}
+
+func (p *producer) PushAfter(d time.Duration, data Marshaler, opts ...PushOption) error {
+	return p.PushAt(time.Now().Add(d), data, opts...)
+}
+
+// delayShard 有 key 的消息和普通消息一样按 key 选择分片，否则随机选择
+func (p *producer) delayShard(m *outMessage) (int, error) {
+	if m.keyed {
+		return shardOf(m.key, p.shards()), nil
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(p.shards())))
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n.Int64()), nil
+}
+
+// acceptDelayed 在锁内检查生产者是否已经关闭并启动转移协程，之后的 ZADD 不持有锁，Redis 慢时不阻塞 CloseContext。
+// 检查之后才关闭时写入的消息由其他节点的转移协程转移
+func (p *producer) acceptDelayed() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	select {
+	case <-p.closing:
+		return ErrClosed
+	default:
+	}
+
+	p.startMover()
+	return nil
+}
+
+// startMover 生产者的转移协程只启动一次
+func (p *producer) startMover() {
+	p.moverOnce.Do(func() {
+		p.wg.Add(1)
+		go func() {
+			p.moveDelayed(p.DelayPeriod, p.PipeBufferSize, p.MaxLen, p.done, p.emitter)
+			p.wg.Done()
+		}()
+	})
+}
+
+// moveDelayed 定期转移到期的延迟消息，每次每个分片最多转移 count 条，可以在多个节点上同时运行。
+// 设置了 MoveDelayed 的消费者也转移，写入延迟消息的生产者关闭后到期的消息也会被消费
+func (c *client) moveDelayed(period time.Duration, count int64, maxLen int64, done <-chan struct{}, emitter ErrorNotifier) {
+	tick := time.NewTicker(period)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+		}
+
+		now := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+		for lane := 0; lane < c.lanes; lane++ {
+			for i := 0; i < c.shards(); i++ {
+				keys := []string{c.delayedOf(lane, i), c.streamOf(lane, i)}
+				err := moveScript.Run(c.redisClient, keys, now, count, maxLen).Err()
+				if err != nil && err != redis.Nil && emitter != nil {
+					emitter.EmitError(err)
+				}
+			}
+		}
+	}
+}
+
+// encodeDelayed 把消息编码成有序集合的成员，格式为若干个 "长度:内容"，
+// 第一项是随机id，保证内容相同的消息不会被合并，之后是队列中的字段名和值
+func encodeDelayed(m *outMessage) (string, error) {
+	id, err := newMessageID()
+	if err != nil {
+		return "", err
+	}
+
+	b := &strings.Builder{}
+	write := func(s string) {
+		b.WriteString(strconv.Itoa(len(s)))
+		b.WriteByte(':')
+		b.WriteString(s)
+	}
+
+	write(id)
+	write(dataField)
+	write(string(m.body))
+	for k, v := range m.headers {
+		write(headerPrefix + k)
+		write(v)
+	}
+
+	return b.String(), nil
+}
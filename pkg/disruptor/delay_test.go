@@ -0,0 +1,96 @@
+package disruptor_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/sinuxlee/tile/pkg/disruptor"
+	"github.com/sinuxlee/tile/pkg/disruptor/disruptortest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelayedAfterProducerClosed(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+
+	// 写入延迟消息的生产者在到期前关闭，由消费者转移
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: "delayed", ShardsCount: 2}, cli)
+	require.NoError(t, err)
+	start := time.Now()
+	require.NoError(t, pr.PushAfter(100*time.Millisecond, pr.Value(&order{Seq: 1})))
+	pr.Close()
+
+	cn, err := disruptor.NewConsumer(&disruptor.ConsumerOptions{
+		QueueName: "delayed", Consumer: "c1", ShardsCount: 2, Block: 10 * time.Millisecond, DelayPeriod: 10 * time.Millisecond, MoveDelayed: true,
+	}, cli)
+	require.NoError(t, err)
+	defer cn.Close()
+
+	require.NoError(t, popTimeout(cn, func(m disruptor.Message) error {
+		assert.Equal(t, 1, m.Data.(*order).Seq)
+		return nil
+	}))
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+}
+
+func TestPushAt(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: "scheduled", ShardsCount: 2, DelayPeriod: 10 * time.Millisecond}, cli)
+	require.NoError(t, err)
+	defer pr.Close()
+
+	cn, err := disruptor.NewConsumer(&disruptor.ConsumerOptions{
+		QueueName: "scheduled", Consumer: "c1", ShardsCount: 2, Block: 10 * time.Millisecond,
+	}, cli)
+	require.NoError(t, err)
+	defer cn.Close()
+
+	// 先到期的消息先投递，有 key 的延迟消息和普通消息写入同一个分片
+	at := time.Now().Add(100 * time.Millisecond)
+	require.NoError(t, pr.PushAt(at.Add(50*time.Millisecond), pr.Value(&order{Seq: 2}), disruptor.WithKey("k")))
+	require.NoError(t, pr.PushAt(at, pr.Value(&order{Seq: 1}), disruptor.WithKey("k")))
+
+	for _, seq := range []int{1, 2} {
+		require.NoError(t, popTimeout(cn, func(m disruptor.Message) error {
+			assert.Equal(t, seq, m.Data.(*order).Seq)
+			assert.False(t, time.Now().Before(at))
+			assert.NotEmpty(t, m.Headers.Get(disruptor.HeaderDeliverAt))
+			return nil
+		}))
+	}
+}
+
+func TestPushAtSlowRedis(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: "slow_delayed", ShardsCount: 2}, cli)
+	require.NoError(t, err)
+
+	// ZADD 阻塞时关闭生产者不需要等待它
+	started, release := make(chan struct{}), make(chan struct{})
+	cli.(*redis.Client).AddHook(cmdHook(func(cmd redis.Cmder) error {
+		if cmd.Name() == "zadd" {
+			close(started)
+			<-release
+		}
+		return nil
+	}))
+
+	pushed := make(chan error, 1)
+	go func() {
+		pushed <- pr.PushAfter(time.Minute, pr.Value(&order{Seq: 1}))
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = pr.CloseContext(ctx)
+	assert.NoError(t, err)
+
+	close(release)
+	assert.NoError(t, <-pushed)
+	assert.Equal(t, disruptor.ErrClosed, pr.PushAfter(time.Minute, pr.Value(&order{Seq: 2})))
+}
@@ -0,0 +1,327 @@
+package disruptor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+var (
+	// ErrNoDescriptor 队列还没有创建
+	ErrNoDescriptor = errors.New("disruptor: queue descriptor not found")
+	// ErrCodecMismatch 配置的编码方式和队列创建时的不一致
+	ErrCodecMismatch = errors.New("disruptor: codec does not match the queue descriptor")
+	// ErrShrinkShards 只能增加分片数量
+	ErrShrinkShards = errors.New("disruptor: shards count can only grow")
+	// ErrTooManyShards 查询的分片数量超过队列的分片数量或者 MaxShards
+	ErrTooManyShards = errors.New("disruptor: shards count exceeds the queue")
+	// ErrLanesGrown 队列增加了优先级，运行中的生产者和消费者需要重新创建才能使用新的优先级
+	ErrLanesGrown = errors.New("disruptor: queue has more priorities than the client, recreate it to use them")
+)
+
+// 队列描述的字段
+const (
+	shardsField  = "shards"
+	codecField   = "codec"
+	createdField = "created"
+	tagsField    = "tags"
+	lanesField   = "lanes"
+)
+
+// reshardScript 只在新的分片数量更大时才修改，避免并发的重新分片把数量改小，ARGV[2] 为空时队列没有记录 tag
+var reshardScript = redis.NewScript(`
+local shards = tonumber(redis.call('HGET', KEYS[1], 'shards'))
+if shards == nil then
+	return redis.error_reply('queue descriptor not found')
+end
+if shards < tonumber(ARGV[1]) then
+	redis.call('HSET', KEYS[1], 'shards', ARGV[1])
+	if ARGV[2] ~= '' then
+		redis.call('HSET', KEYS[1], 'tags', ARGV[2])
+	end
+	return 1
+end
+return 0
+`)
+
+// lanesScript 只增加优先级的数量，旧版本创建的队列没有记录时为1
+var lanesScript = redis.NewScript(`
+local lanes = tonumber(redis.call('HGET', KEYS[1], 'lanes') or '1')
+if lanes < tonumber(ARGV[1]) then
+	redis.call('HSET', KEYS[1], 'lanes', ARGV[1])
+	return 1
+end
+return 0
+`)
+
+// Descriptor 持久化在 Redis 中的队列描述，生产者和消费者以它为准
+type Descriptor struct {
+	Shards  int       `json:"shards"`
+	Codec   string    `json:"codec"`
+	Created time.Time `json:"created"`
+	Tags    []string  `json:"tags,omitempty"` // 各个分片的 hash tag，为空时使用分片序号
+	Lanes   int       `json:"lanes"`          // 生产者和消费者使用过的最多的优先级数量，每个优先级使用一组分片
+}
+
+// tag 分片的 hash tag，旧版本创建的队列没有记录
+func (d *Descriptor) tag(shard int) string {
+	if shard < len(d.Tags) {
+		return d.Tags[shard]
+	}
+
+	return ""
+}
+
+// streamName 队列分片的 key
+func (d *Descriptor) streamName(queue string, shard int) string {
+	return makeStreamName(queue, d.tag(shard), shard)
+}
+
+// ReadDescriptor 读取队列描述，队列还没有创建时返回 ErrNoDescriptor
+func ReadDescriptor(cli redis.UniversalClient, queue string) (*Descriptor, error) {
+	fields, err := cli.HGetAll(makeMetaName(queue)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return parseDescriptor(fields)
+}
+
+// readOrLegacyDescriptor 读取队列描述。explicit 为 true 表示调用方指定了分片，
+// 这时没有队列描述的旧队列按一个优先级、分片序号作为 hash tag 处理
+func readOrLegacyDescriptor(cli redis.UniversalClient, queue string, explicit bool) (*Descriptor, error) {
+	desc, err := ReadDescriptor(cli, queue)
+	if err == ErrNoDescriptor && explicit {
+		return &Descriptor{Lanes: 1}, nil
+	}
+
+	return desc, err
+}
+
+// loadDescriptor 队列不存在时按配置创建描述，分片的 hash tag 由 naming 选择，存在时读取并校验编码方式。
+// lanes 大于记录的优先级数量时更新，Replay、Inspect 和 Reshard 按记录的数量处理各个优先级
+func loadDescriptor(cli redis.UniversalClient, queue string, shards int, lanes int, codec string, naming Naming) (*Descriptor, error) {
+	desc, err := ReadDescriptor(cli, queue)
+	if err == ErrNoDescriptor {
+		desc, err = createDescriptor(cli, queue, shards, lanes, codec, naming)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if desc.Codec != codec {
+		return nil, fmt.Errorf("%w: queue %v uses %v, got %v", ErrCodecMismatch, queue, desc.Codec, codec)
+	}
+
+	if desc.Lanes < lanes {
+		if err := lanesScript.Run(cli, []string{makeMetaName(queue)}, lanes).Err(); err != nil {
+			return nil, err
+		}
+
+		desc.Lanes = lanes
+	}
+
+	return desc, nil
+}
+
+// createDescriptor 多个节点同时创建时以第一个写入的为准。旧版本创建的队列没有描述，
+// 已经存在按分片序号命名的 key 时使用 ShardNaming，继续读写原来的分片
+func createDescriptor(cli redis.UniversalClient, queue string, shards int, lanes int, codec string, naming Naming) (*Descriptor, error) {
+	legacy, err := hasLegacyKeys(cli, queue, shards)
+	if err != nil {
+		return nil, err
+	}
+
+	if legacy {
+		naming = ShardNaming{}
+	}
+
+	tags, err := encodeTags(cli, queue, 0, shards, naming, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	key := makeMetaName(queue)
+	created := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+
+	pipe := cli.TxPipeline()
+	pipe.HSetNX(key, shardsField, shards)
+	pipe.HSetNX(key, codecField, codec)
+	pipe.HSetNX(key, createdField, created)
+	pipe.HSetNX(key, lanesField, lanes)
+	if tags != "" {
+		pipe.HSetNX(key, tagsField, tags)
+	}
+	all := pipe.HGetAll(key)
+
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+
+	return parseDescriptor(all.Val())
+}
+
+// hasLegacyKeys 是否存在按分片序号命名的分片或者延迟消息，集群中各个 key 分别查询
+func hasLegacyKeys(cli redis.UniversalClient, queue string, shards int) (bool, error) {
+	pipe := cli.Pipeline()
+	cmds := make([]*redis.IntCmd, 0, 2*shards)
+	for i := 0; i < shards; i++ {
+		cmds = append(cmds, pipe.Exists(makeStreamName(queue, "", i)), pipe.Exists(makeDelayedName(queue, "", i)))
+	}
+
+	if _, err := pipe.Exec(); err != nil {
+		return false, err
+	}
+
+	for _, cmd := range cmds {
+		if cmd.Val() > 0 {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// encodeTags 为分片 from 到 to-1 选择 hash tag，追加到 prev 之后编码。所有的 tag 都为空时返回空字符串
+func encodeTags(cli redis.UniversalClient, queue string, from, to int, naming Naming, prev []string) (string, error) {
+	tags, err := naming.Tags(cli, queue, from, to)
+	if err != nil {
+		return "", err
+	}
+
+	tags = append(append(make([]string, 0, to), prev...), tags...)
+	for _, tag := range tags {
+		if tag != "" {
+			b, err := json.Marshal(tags)
+			return string(b), err
+		}
+	}
+
+	return "", nil
+}
+
+func parseDescriptor(fields map[string]string) (*Descriptor, error) {
+	if len(fields) == 0 {
+		return nil, ErrNoDescriptor
+	}
+
+	shards, err := strconv.Atoi(fields[shardsField])
+	if err != nil {
+		return nil, err
+	}
+
+	ms, _ := strconv.ParseInt(fields[createdField], 10, 64)
+
+	desc := &Descriptor{
+		Shards:  shards,
+		Codec:   fields[codecField],
+		Created: time.Unix(0, ms*int64(time.Millisecond)),
+		Lanes:   1,
+	}
+
+	if lanes := fields[lanesField]; lanes != "" {
+		if desc.Lanes, err = strconv.Atoi(lanes); err != nil {
+			return nil, err
+		}
+	}
+
+	if tags := fields[tagsField]; tags != "" {
+		if err := json.Unmarshal([]byte(tags), &desc.Tags); err != nil {
+			return nil, err
+		}
+	}
+
+	return desc, nil
+}
+
+// Reshard 把队列的分片数量增加到 shards，正在运行的生产者和消费者在 WatchPeriod 内开始使用新的分片，
+// 消费者会继续消费原来的分片。新的分片上创建队列已有的所有消费组，消费者发现新分片之前写入的消息不会错过。
+// 分片数量变化前后相同 key 的消息会写入不同的分片，这段时间内不保证顺序。
+// 新的分片使用 SlotNaming，旧版本创建的没有记录 hash tag 的队列继续使用分片序号
+func Reshard(cli redis.UniversalClient, queue string, shards int) error {
+	return ReshardNaming(cli, queue, shards, nil)
+}
+
+// ReshardNaming 和 Reshard 相同，新的分片使用 naming 选择 hash tag
+func ReshardNaming(cli redis.UniversalClient, queue string, shards int, naming Naming) error {
+	desc, err := ReadDescriptor(cli, queue)
+	if err != nil {
+		return err
+	}
+
+	if shards <= desc.Shards {
+		return ErrShrinkShards
+	}
+
+	if naming == nil {
+		naming = SlotNaming{}
+		if len(desc.Tags) == 0 {
+			naming = ShardNaming{}
+		}
+	}
+
+	prev := make([]string, desc.Shards)
+	copy(prev, desc.Tags)
+	tags, err := encodeTags(cli, queue, desc.Shards, shards, naming, prev)
+	if err != nil {
+		return err
+	}
+
+	next := &Descriptor{Shards: shards}
+	if tags != "" {
+		if err := json.Unmarshal([]byte(tags), &next.Tags); err != nil {
+			return err
+		}
+	}
+
+	// 更新分片数量之前在所有优先级的新分片上创建分片0已有的消费组，从第一条消息开始消费。
+	// 生产者开始写入新分片时消费者可能还没有发现新分片，消息留在各个消费组中等待读取
+	d := &redisDriver{cli: cli}
+	for lane := 0; lane < desc.Lanes; lane++ {
+		laneQueue := makeLaneName(queue, lane)
+		groups, err := d.groups(desc.streamName(laneQueue, 0))
+		if err != nil {
+			return err
+		}
+
+		for i := desc.Shards; i < shards; i++ {
+			for _, group := range groups {
+				if err := d.createShard(next.streamName(laneQueue, i), group, "0"); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return reshardScript.Run(cli, []string{makeMetaName(queue)}, shards, tags).Err()
+}
+
+// DeleteQueue 删除队列的描述、所有优先级的分片、延迟消息和死信队列，没有队列描述时不做修改。
+// 需要在队列的生产者和消费者都关闭后调用，还在运行的生产者会重新创建分片
+func DeleteQueue(cli redis.UniversalClient, queue string) error {
+	desc, err := ReadDescriptor(cli, queue)
+	if err == ErrNoDescriptor {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// 分片和延迟消息使用相同的 hash tag，集群中其他 key 分别删除
+	pipe := cli.Pipeline()
+	for lane := 0; lane < desc.Lanes; lane++ {
+		laneQueue := makeLaneName(queue, lane)
+		for i := 0; i < desc.Shards; i++ {
+			pipe.Del(desc.streamName(laneQueue, i), makeDelayedName(laneQueue, desc.tag(i), i))
+		}
+	}
+	pipe.Del(makeDeadLetterName(queue))
+	pipe.Del(makeMetaName(queue))
+
+	_, err = pipe.Exec()
+	return err
+}
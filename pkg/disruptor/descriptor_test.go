@@ -0,0 +1,92 @@
+package disruptor_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/sinuxlee/tile/pkg/disruptor"
+	"github.com/sinuxlee/tile/pkg/disruptor/disruptortest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLegacyQueueUpgrade(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+
+	// 旧版本创建的队列没有描述，c1 读取了一条消息还没有 ack
+	stream := "disruptor:legacy:{0}"
+	require.NoError(t, cli.XGroupCreateMkStream(stream, "disruptor_legacy_group", "0").Err())
+	for _, body := range []string{`{"seq":0}`, `{"seq":1}`} {
+		require.NoError(t, cli.XAdd(&redis.XAddArgs{Stream: stream, Values: map[string]interface{}{"data": body}}).Err())
+	}
+	require.NoError(t, cli.XReadGroup(&redis.XReadGroupArgs{
+		Group: "disruptor_legacy_group", Consumer: "c1", Streams: []string{stream, ">"}, Count: 1,
+	}).Err())
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: "legacy", ShardsCount: 1, PipePeriod: 5 * time.Millisecond}, cli)
+	require.NoError(t, err)
+	require.NoError(t, pr.Push(pr.Value(&order{Seq: 2})))
+	pr.Close()
+
+	desc, err := disruptor.ReadDescriptor(cli, "legacy")
+	require.NoError(t, err)
+	assert.Empty(t, desc.Tags)
+
+	cn, err := disruptor.NewConsumer(&disruptor.ConsumerOptions{
+		QueueName: "legacy", Consumer: "c1", ShardsCount: 1, Block: 10 * time.Millisecond, PipePeriod: 5 * time.Millisecond,
+	}, cli)
+	require.NoError(t, err)
+	defer cn.Close()
+
+	for i := 0; i < 3; i++ {
+		err, _ := cn.Pop(cn.Value(&order{}), func(m disruptor.Message) error {
+			assert.Equal(t, stream, m.Stream)
+			assert.Equal(t, i, m.Data.(*order).Seq)
+			return nil
+		})
+		require.NoError(t, err)
+	}
+}
+
+func TestReshardNamedGroup(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+
+	// 生产者比消费者更早发现新的分片
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{
+		QueueName: "growing", ShardsCount: 1, PipePeriod: 5 * time.Millisecond, WatchPeriod: 20 * time.Millisecond,
+	}, cli)
+	require.NoError(t, err)
+	defer pr.Close()
+
+	cn, err := disruptor.NewConsumer(&disruptor.ConsumerOptions{
+		QueueName: "growing", Consumer: "c1", Group: "analytics", ShardsCount: 1, Block: 10 * time.Millisecond,
+		PipePeriod: 5 * time.Millisecond, WatchPeriod: 500 * time.Millisecond,
+	}, cli)
+	require.NoError(t, err)
+	defer cn.Close()
+
+	require.NoError(t, disruptor.Reshard(cli, "growing", 4))
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 40; i++ {
+		_, err := pr.PushSync(context.Background(), pr.Value(&order{Seq: i}), disruptor.WithKey(strconv.Itoa(i)))
+		require.NoError(t, err)
+	}
+
+	// 消费者发现新分片之前写入的消息也会收到
+	info, err := disruptor.Inspect(cli, "growing", "analytics", 0)
+	require.NoError(t, err)
+	assert.Less(t, info.Shards[0].Length, int64(40))
+
+	seqs := make(map[int]bool)
+	for i := 0; i < 40; i++ {
+		require.NoError(t, popTimeout(cn, func(m disruptor.Message) error {
+			seqs[m.Data.(*order).Seq] = true
+			return nil
+		}))
+	}
+	assert.Len(t, seqs, 40)
+}
@@ -1,6 +1,11 @@
 package disruptor
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
 
 // 100W条445字节的数据，大概占用550M内存，gzip可以减少30%的内存。
 
@@ -8,19 +13,42 @@ const (
 	dataField = "data"
 )
 
+var (
+	// ErrBufferFull 本地消息缓冲已满
+	ErrBufferFull = errors.New("disruptor: pending buffer is full")
+	// ErrClosed 生产者已经关闭
+	ErrClosed = errors.New("disruptor: producer is closed")
+	// ErrSpilled 消息暂时写入了本地文件，Redis 恢复后重新发送
+	ErrSpilled = errors.New("disruptor: message spilled to local disk")
+	// ErrSpillLocked SpillDir 中队列的段文件正在被其他生产者使用
+	ErrSpillLocked = errors.New("disruptor: spill dir is locked by another producer")
+)
+
 type Marshaler interface {
 	Marshal() ([]byte, error)
 	Unmarshal(data []byte) error
 }
 
+// Keyed 由 Marshaler 选择实现，相同 key 的消息写入同一个分片，保证按顺序消费
+type Keyed interface {
+	Key() string
+}
+
 type Handler func(m Message) error
 
+// ConfirmFunc 接收消息的发送结果，成功时 id 为消息在队列中的id
+type ConfirmFunc func(id string, err error)
+
 // Message from queue
 type Message struct {
-	ID     string
-	Stream string
-	Group  string
-	Body   []byte
+	ID      string
+	Stream  string
+	Group   string
+	Body    []byte
+	Headers Headers
+	Data    interface{} // 解码后的消息体，Value 创建的 Marshaler 为传入的 v
+	shard   int
+	lane    int
 }
 
 type ErrorNotifier interface {
@@ -29,18 +57,93 @@ type ErrorNotifier interface {
 
 type Consumer interface {
 	Pop(data Marshaler, h Handler) (error, bool)
+	// PopContext 等待消息直到 ctx 结束，ctx 结束时返回 ctx.Err()
+	PopContext(ctx context.Context, data Marshaler, h Handler) (error, bool)
+	// Value 返回使用 ConsumerOptions.Codec 解码到 v 的 Marshaler
+	Value(v interface{}) Marshaler
+	// Run 启动 workers 个协程并发处理消息，每条消息使用 factory 创建新的解码对象。
+	// 同一个分片的消息按顺序处理，不同分片的消息并发处理，并发度不超过分片数量。
+	// ctx 结束或者 Close 后本地缓冲处理完时返回
+	Run(ctx context.Context, workers int, factory func() Marshaler, h Handler) error
+	// PopBatch 等待第一条消息后最多再等待 wait，收集到 max 条消息一次交给 h 处理，
+	// factory 为每条消息创建解码对象。ctx 结束时返回 ctx.Err()，关闭后返回 false
+	PopBatch(ctx context.Context, max int, wait time.Duration, factory func() Marshaler, h BatchHandler) (error, bool)
 	Close()
 }
 
 type Producer interface {
+	// Close 等待本地缓冲中的消息全部发送完成，Redis 不可用时可能一直等待
 	Close()
-	Push(data Marshaler) error
+	// CloseContext 在 ctx 结束前尽量发送本地缓冲中的消息，ctx 结束后停止重试，不再等待正在进行的写入，
+	// 也不再重新发送 SpillDir 中的消息。返回没有发送成功也没有写入 SpillDir 的消息数
+	CloseContext(ctx context.Context) (dropped int, err error)
+	Push(data Marshaler, opts ...PushOption) error
+	// PushContext 本地缓冲已满时等待直到 ctx 结束，ctx 结束时返回 ctx.Err()
+	PushContext(ctx context.Context, data Marshaler, opts ...PushOption) error
+	// TryPush 本地缓冲已满时立即返回 ErrBufferFull
+	TryPush(data Marshaler, opts ...PushOption) error
+	// PushConfirm 消息写入队列或者重试后最终失败时调用 cb，cb 在发送协程中执行，不能阻塞
+	PushConfirm(data Marshaler, cb ConfirmFunc, opts ...PushOption) error
+	// PushSync 等待消息写入队列，返回消息在队列中的id
+	PushSync(ctx context.Context, data Marshaler, opts ...PushOption) (string, error)
+	// Value 返回使用 ProducerOptions.Codec 编码 v 的 Marshaler
+	Value(v interface{}) Marshaler
+	// PushAt 消息在 at 时刻之后才会被消费，直接写入 Redis 不经过本地缓冲，其他后端返回 ErrNotSupported
+	PushAt(at time.Time, data Marshaler, opts ...PushOption) error
+	// PushAfter 消息在 d 时长之后才会被消费
+	PushAfter(d time.Duration, data Marshaler, opts ...PushOption) error
 }
 
-func makeStreamName(name string, shard int) string {
-	return fmt.Sprintf("disruptor:%v:{%v}", name, shard)
+// makeStreamName tag 为空时使用分片序号作为 hash tag，和旧版本创建的队列相同
+func makeStreamName(name string, tag string, shard int) string {
+	if tag == "" {
+		return fmt.Sprintf("disruptor:%v:{%v}", name, shard)
+	}
+
+	return fmt.Sprintf("disruptor:%v:{%v}:%v", name, tag, shard)
+}
+
+// makeLaneName 优先级大于0的消息写入单独的一组分片，优先级0使用原来的分片
+func makeLaneName(name string, lane int) string {
+	if lane == 0 {
+		return name
+	}
+
+	return fmt.Sprintf("%v:priority:%v", name, lane)
 }
 
 func makeGroupName(name string) string {
 	return fmt.Sprintf("disruptor_%v_group", name)
 }
+
+// DefaultGroup 没有设置 ConsumerOptions.Group 的消费者使用的消费组。
+// 由第一个使用它的消费者创建，从分片中保留的第一条消息开始消费，生产者不会创建
+func DefaultGroup(queue string) string {
+	return makeGroupName(queue)
+}
+
+// makeLaneGroup 优先级 lane 使用的消费组，默认消费组和队列一样按优先级区分，自定义消费组在各个优先级上同名
+func makeLaneGroup(name string, group string, lane int) string {
+	if group == makeGroupName(name) {
+		return makeGroupName(makeLaneName(name, lane))
+	}
+
+	return group
+}
+
+func makeMetaName(name string) string {
+	return fmt.Sprintf("disruptor:%v:meta", name)
+}
+
+func makeDeadLetterName(name string) string {
+	return fmt.Sprintf("disruptor:%v:dead", name)
+}
+
+// makeDelayedName 和同一个分片的队列使用相同的 hash tag，保证在集群中位于同一个 slot
+func makeDelayedName(name string, tag string, shard int) string {
+	if tag == "" {
+		return fmt.Sprintf("disruptor:%v:delayed:{%v}", name, shard)
+	}
+
+	return fmt.Sprintf("disruptor:%v:delayed:{%v}:%v", name, tag, shard)
+}
@@ -0,0 +1,431 @@
+package disruptortest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sinuxlee/tile/pkg/disruptor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// event 一致性测试使用的消息
+type event struct {
+	Player string `json:"player"`
+	Seq    int    `json:"seq"`
+}
+
+func (e *event) Key() string {
+	return e.Player
+}
+
+// Run 对 newBackend 创建的实现运行一致性测试，每个子测试使用新的 Backend
+func Run(t *testing.T, newBackend func(t testing.TB) Backend) {
+	t.Run("PushPop", func(t *testing.T) { testPushPop(t, newBackend(t)) })
+	t.Run("KeyedOrder", func(t *testing.T) { testKeyedOrder(t, newBackend(t)) })
+	t.Run("Backlog", func(t *testing.T) { testBacklog(t, newBackend(t)) })
+	t.Run("FanOut", func(t *testing.T) { testFanOut(t, newBackend(t)) })
+	t.Run("Retry", func(t *testing.T) { testRetry(t, newBackend(t)) })
+	t.Run("DeadLetter", func(t *testing.T) { testDeadLetter(t, newBackend(t)) })
+	t.Run("Run", func(t *testing.T) { testRun(t, newBackend(t)) })
+	t.Run("RunKeyedOrder", func(t *testing.T) { testRunKeyedOrder(t, newBackend(t)) })
+	t.Run("RunConcurrent", func(t *testing.T) { testRunConcurrent(t, newBackend(t)) })
+	t.Run("Batch", func(t *testing.T) { testBatch(t, newBackend(t)) })
+	t.Run("Closed", func(t *testing.T) { testClosed(t, newBackend(t)) })
+}
+
+func producer(t *testing.T, b Backend, queue string) disruptor.Producer {
+	pr, err := b.NewProducer(&disruptor.ProducerOptions{
+		QueueName:   queue,
+		ShardsCount: 2,
+		PipePeriod:  5 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	return pr
+}
+
+func consumer(t *testing.T, b Backend, queue string, name string, group string) disruptor.Consumer {
+	cn, err := b.NewConsumer(&disruptor.ConsumerOptions{
+		QueueName:   queue,
+		Consumer:    name,
+		Group:       group,
+		ShardsCount: 2,
+		Block:       10 * time.Millisecond,
+		PipePeriod:  5 * time.Millisecond,
+		Retry:       disruptor.RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond},
+	})
+	require.NoError(t, err)
+
+	return cn
+}
+
+// pop 处理 n 条消息，返回处理的消息
+func pop(t *testing.T, cn disruptor.Consumer, n int) []disruptor.Message {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var res []disruptor.Message
+	for len(res) < n {
+		err, _ := cn.PopContext(ctx, cn.Value(&event{}), func(m disruptor.Message) error {
+			res = append(res, m)
+			return nil
+		})
+		require.NoErrorf(t, err, "received %v of %v messages", len(res), n)
+	}
+
+	return res
+}
+
+func testPushPop(t *testing.T, b Backend) {
+	pr := producer(t, b, "push_pop")
+	cn := consumer(t, b, "push_pop", "c1", "")
+	defer cn.Close()
+
+	require.NoError(t, pr.Push(pr.Value(&event{Player: "p1", Seq: 1}), disruptor.WithHeader(disruptor.HeaderTraceID, "t1")))
+	id, err := pr.PushSync(context.Background(), pr.Value(&event{Player: "p2", Seq: 2}))
+	require.NoError(t, err)
+	assert.NotEmpty(t, id)
+	pr.Close()
+
+	msgs := pop(t, cn, 2)
+	seen := make(map[int]disruptor.Message)
+	for _, m := range msgs {
+		seen[m.Data.(*event).Seq] = m
+	}
+
+	require.Len(t, seen, 2)
+	assert.Equal(t, "t1", seen[1].Headers.Get(disruptor.HeaderTraceID))
+	assert.Equal(t, "p2", seen[2].Data.(*event).Player)
+	assert.Equal(t, id, seen[2].ID)
+	assert.NotEmpty(t, seen[1].Headers.Get(disruptor.HeaderMessageID))
+	assert.False(t, seen[1].Headers.PublishedAt().IsZero())
+}
+
+func testKeyedOrder(t *testing.T, b Backend) {
+	pr := producer(t, b, "keyed")
+	cn := consumer(t, b, "keyed", "c1", "")
+	defer cn.Close()
+
+	for i := 0; i < 50; i++ {
+		require.NoError(t, pr.Push(pr.Value(&event{Player: fmt.Sprintf("p%v", i%2), Seq: i})))
+	}
+	pr.Close()
+
+	last := map[string]int{"p0": -1, "p1": -1}
+	for _, m := range pop(t, cn, 50) {
+		e := m.Data.(*event)
+		assert.Greaterf(t, e.Seq, last[e.Player], "messages of %v out of order", e.Player)
+		last[e.Player] = e.Seq
+	}
+}
+
+func testBacklog(t *testing.T, b Backend) {
+	pr := producer(t, b, "backlog")
+	cn := consumer(t, b, "backlog", "c1", "")
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, pr.Push(pr.Value(&event{Player: "p1", Seq: i})))
+	}
+	pr.Close()
+
+	// 处理一条后关闭，已经读取到本地缓冲的消息留给同名的消费者
+	first := pop(t, cn, 1)
+	time.Sleep(50 * time.Millisecond)
+	cn.Close()
+
+	cn = consumer(t, b, "backlog", "c1", "")
+	defer cn.Close()
+
+	rest := pop(t, cn, 2)
+	assert.Equal(t, 0, first[0].Data.(*event).Seq)
+	assert.Equal(t, 1, rest[0].Data.(*event).Seq)
+	assert.Equal(t, 2, rest[1].Data.(*event).Seq)
+
+	// ack 过的消息不会再次投递
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err, _ := cn.PopContext(ctx, cn.Value(&event{}), func(m disruptor.Message) error {
+		return fmt.Errorf("unexpected message %v", m.ID)
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func testFanOut(t *testing.T, b Backend) {
+	pr := producer(t, b, "fan_out")
+	main := consumer(t, b, "fan_out", "c1", "")
+	defer main.Close()
+	// 只创建消费组，默认消费组处理完之后才开始读取
+	consumer(t, b, "fan_out", "c1", "analytics").Close()
+	notify := consumer(t, b, "fan_out", "c1", "notify")
+	defer notify.Close()
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, pr.Push(pr.Value(&event{Player: "p1", Seq: i})))
+	}
+	pr.Close()
+
+	// 默认消费组先处理完并 ack，其他消费组之后仍然收到全部消息
+	assert.Len(t, pop(t, main, 5), 5)
+	time.Sleep(50 * time.Millisecond)
+
+	analytics := consumer(t, b, "fan_out", "c1", "analytics")
+	defer analytics.Close()
+	assert.Len(t, pop(t, analytics, 5), 5)
+	assert.Len(t, pop(t, notify, 5), 5)
+}
+
+func testRetry(t *testing.T, b Backend) {
+	pr := producer(t, b, "retry")
+	cn := consumer(t, b, "retry", "c1", "")
+	defer cn.Close()
+
+	require.NoError(t, pr.Push(pr.Value(&event{Player: "p1"})))
+	pr.Close()
+
+	calls := 0
+	err, _ := cn.Pop(cn.Value(&event{}), func(m disruptor.Message) error {
+		calls++
+		if calls == 1 {
+			return errors.New("first attempt fails")
+		}
+
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+}
+
+func testDeadLetter(t *testing.T, b Backend) {
+	if b.DeadLetters == nil {
+		t.Skip("dead letters not supported")
+	}
+
+	pr := producer(t, b, "dead")
+	cn, err := b.NewConsumer(&disruptor.ConsumerOptions{
+		QueueName: "dead", Consumer: "c1", ShardsCount: 2, Block: 10 * time.Millisecond, PipePeriod: 5 * time.Millisecond,
+		DeadLetter: true, Retry: disruptor.RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond},
+	})
+	require.NoError(t, err)
+	defer cn.Close()
+
+	require.NoError(t, pr.Push(pr.Value(&event{Player: "p1", Seq: 1}), disruptor.WithHeader(disruptor.HeaderTraceID, "t1")))
+	pr.Close()
+
+	var origin disruptor.Message
+	err, _ = cn.Pop(cn.Value(&event{}), func(m disruptor.Message) error {
+		origin = m
+		return errors.New("always fails")
+	})
+	assert.EqualError(t, err, "always fails")
+
+	// 两种实现的死信消息保留消息体和原消息头，失败的信息记录在消息头中
+	dead, err := b.DeadLetters("dead")
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	assert.Equal(t, origin.Body, dead[0].Body)
+	assert.Equal(t, "t1", dead[0].Headers.Get(disruptor.HeaderTraceID))
+	assert.Equal(t, "always fails", dead[0].Headers.Get(disruptor.HeaderError))
+	assert.Equal(t, "2", dead[0].Headers.Get(disruptor.HeaderAttempts))
+	assert.Equal(t, origin.ID, dead[0].Headers.Get(disruptor.HeaderOriginID))
+	assert.Equal(t, origin.Stream, dead[0].Headers.Get(disruptor.HeaderOriginStream))
+}
+
+func testRun(t *testing.T, b Backend) {
+	pr := producer(t, b, "run")
+	cn := consumer(t, b, "run", "c1", "")
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, pr.Push(pr.Value(&event{Player: fmt.Sprintf("p%v", i), Seq: i})))
+	}
+	pr.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	mu := sync.Mutex{}
+	seen := make(map[int]bool)
+	go func() {
+		_ = cn.Run(ctx, 4, func() disruptor.Marshaler { return cn.Value(&event{}) }, func(m disruptor.Message) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			seen[m.Data.(*event).Seq] = true
+			if len(seen) == 20 {
+				cancel()
+			}
+			return nil
+		})
+	}()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for Run")
+	}
+
+	cn.Close()
+	mu.Lock()
+	assert.Len(t, seen, 20)
+	mu.Unlock()
+}
+
+func testRunKeyedOrder(t *testing.T, b Backend) {
+	pr := producer(t, b, "runkeyed")
+	cn := consumer(t, b, "runkeyed", "c1", "")
+
+	for i := 0; i < 50; i++ {
+		require.NoError(t, pr.Push(pr.Value(&event{Player: fmt.Sprintf("p%v", i%2), Seq: i})))
+	}
+	pr.Close()
+
+	// 处理时间不同的多个协程也不会打乱同一个 key 的顺序
+	ctx, cancel := context.WithCancel(context.Background())
+	mu := sync.Mutex{}
+	last := map[string]int{"p0": -1, "p1": -1}
+	count := 0
+	go func() {
+		_ = cn.Run(ctx, 4, func() disruptor.Marshaler { return cn.Value(&event{}) }, func(m disruptor.Message) error {
+			e := m.Data.(*event)
+			time.Sleep(time.Duration(e.Seq%3) * time.Millisecond)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			assert.Greaterf(t, e.Seq, last[e.Player], "messages of %v out of order", e.Player)
+			last[e.Player] = e.Seq
+			if count++; count == 50 {
+				cancel()
+			}
+			return nil
+		})
+	}()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for Run")
+	}
+
+	cn.Close()
+}
+
+func testRunConcurrent(t *testing.T, b Backend) {
+	cn := consumer(t, b, "runconcurrent", "c1", "")
+
+	// p0 的第一条消息一直处理到 p1 的消息全部处理完，p0 和 p1 在不同的分片，慢的分片不阻塞其他分片
+	ctx, cancel := context.WithCancel(context.Background())
+	started, unblock := make(chan struct{}), make(chan struct{})
+	var others, count int32
+	stalled := make(chan bool, 1)
+	go func() {
+		_ = cn.Run(ctx, 2, func() disruptor.Marshaler { return cn.Value(&event{}) }, func(m disruptor.Message) error {
+			e := m.Data.(*event)
+			switch {
+			case e.Player == "p0" && e.Seq == 0:
+				close(started)
+				select {
+				case <-unblock:
+					stalled <- false
+				case <-time.After(2 * time.Second):
+					stalled <- true
+				}
+			case e.Player == "p1":
+				if atomic.AddInt32(&others, 1) == 10 {
+					close(unblock)
+				}
+			}
+
+			if atomic.AddInt32(&count, 1) == 20 {
+				cancel()
+			}
+			return nil
+		})
+	}()
+
+	pr := producer(t, b, "runconcurrent")
+	for i := 0; i < 10; i++ {
+		require.NoError(t, pr.Push(pr.Value(&event{Player: "p0", Seq: i})))
+	}
+	pr.Close()
+	<-started
+
+	pr = producer(t, b, "runconcurrent")
+	for i := 0; i < 10; i++ {
+		require.NoError(t, pr.Push(pr.Value(&event{Player: "p1", Seq: i})))
+	}
+	pr.Close()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for Run")
+	}
+
+	cn.Close()
+	assert.False(t, <-stalled, "messages of p1 waited for p0")
+}
+
+func testBatch(t *testing.T, b Backend) {
+	pr := producer(t, b, "batch")
+	cn := consumer(t, b, "batch", "c1", "")
+	defer cn.Close()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, pr.Push(pr.Value(&event{Player: "p1", Seq: i})))
+	}
+	pr.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 每批的第一条消息第一次处理失败，只有它被重试
+	seen := make(map[int]int)
+	for len(seen) < 10 {
+		err, _ := cn.PopBatch(ctx, 4, 50*time.Millisecond, func() disruptor.Marshaler { return cn.Value(&event{}) },
+			func(ms []disruptor.Message) error {
+				assert.LessOrEqual(t, len(ms), 4)
+
+				failed := make(map[int]error)
+				for i, m := range ms {
+					seq := m.Data.(*event).Seq
+					seen[seq]++
+					if i == 0 && seen[seq] == 1 && len(ms) > 1 {
+						failed[i] = errors.New("first attempt fails")
+					}
+				}
+
+				if len(failed) > 0 {
+					return &disruptor.BatchError{Failed: failed}
+				}
+				return nil
+			})
+		require.NoErrorf(t, err, "received %v of 10 messages", len(seen))
+	}
+
+	for seq, calls := range seen {
+		assert.LessOrEqualf(t, calls, 2, "message %v handled %v times", seq, calls)
+	}
+
+	// 全部 ack，不会再次投递
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err, _ := cn.PopBatch(ctx, 4, time.Millisecond, func() disruptor.Marshaler { return cn.Value(&event{}) },
+		func(ms []disruptor.Message) error {
+			return fmt.Errorf("unexpected %v messages", len(ms))
+		})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func testClosed(t *testing.T, b Backend) {
+	pr := producer(t, b, "closed")
+	dropped, err := pr.CloseContext(context.Background())
+	assert.NoError(t, err)
+	assert.Zero(t, dropped)
+	assert.Equal(t, disruptor.ErrClosed, pr.Push(pr.Value(&event{})))
+	assert.Equal(t, disruptor.ErrClosed, pr.TryPush(pr.Value(&event{})))
+}
@@ -0,0 +1,11 @@
+package disruptortest
+
+import "testing"
+
+func TestMemory(t *testing.T) {
+	Run(t, Memory)
+}
+
+func TestRedis(t *testing.T) {
+	Run(t, Redis)
+}
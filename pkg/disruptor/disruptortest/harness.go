@@ -0,0 +1,71 @@
+// Package disruptortest 提供不需要真实 Redis 的 disruptor 测试工具，
+// 以及内存和 Redis 实现共用的一致性测试
+package disruptortest
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+	"github.com/sinuxlee/tile/pkg/disruptor"
+)
+
+// Backend 创建同一种实现的生产者和消费者
+type Backend struct {
+	Name        string
+	NewProducer func(opt *disruptor.ProducerOptions) (disruptor.Producer, error)
+	NewConsumer func(opt *disruptor.ConsumerOptions) (disruptor.Consumer, error)
+	DeadLetters func(queue string) ([]disruptor.Message, error) // 读取死信队列，不支持死信队列的实现为 nil
+}
+
+// NewRedis 启动进程内的 miniredis，测试结束时关闭
+func NewRedis(t testing.TB) (*miniredis.Miniredis, redis.UniversalClient) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cli := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		_ = cli.Close()
+		mr.Close()
+	})
+
+	return mr, cli
+}
+
+// Redis 使用 miniredis 的 Redis 实现
+func Redis(t testing.TB) Backend {
+	_, cli := NewRedis(t)
+
+	return Backend{
+		Name: "redis",
+		NewProducer: func(opt *disruptor.ProducerOptions) (disruptor.Producer, error) {
+			return disruptor.NewProducer(opt, cli)
+		},
+		NewConsumer: func(opt *disruptor.ConsumerOptions) (disruptor.Consumer, error) {
+			return disruptor.NewConsumer(opt, cli)
+		},
+		DeadLetters: func(queue string) ([]disruptor.Message, error) {
+			return disruptor.DeadLetters(cli, queue)
+		},
+	}
+}
+
+// Memory 内存实现
+func Memory(t testing.TB) Backend {
+	broker := disruptor.NewMemoryBroker()
+
+	return Backend{
+		Name: "memory",
+		NewProducer: func(opt *disruptor.ProducerOptions) (disruptor.Producer, error) {
+			return disruptor.NewMemoryProducer(opt, broker)
+		},
+		NewConsumer: func(opt *disruptor.ConsumerOptions) (disruptor.Consumer, error) {
+			return disruptor.NewMemoryConsumer(opt, broker)
+		},
+		DeadLetters: func(queue string) ([]disruptor.Message, error) {
+			return broker.DeadLetters(queue), nil
+		},
+	}
+}
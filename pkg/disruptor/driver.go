@@ -0,0 +1,68 @@
+package disruptor
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotSupported 当前的后端不支持该功能
+var ErrNotSupported = errors.New("disruptor: not supported by the driver")
+
+// Record 后端写入或者读取的一条消息
+type Record struct {
+	ID      string
+	Body    []byte // 为 nil 时表示消息格式错误，消费者直接ack
+	Headers Headers
+	Owner   string // Claim 返回的消息原来所属的消费者
+}
+
+// ReadArgs 以消费组读取分片的参数
+type ReadArgs struct {
+	Queue    string
+	Shard    int
+	Group    string
+	Consumer string
+	Count    int64
+	Block    time.Duration // 没有消息时等待的时长
+	Backlog  bool          // 读取已经投递给 Consumer 还没有ack的消息，不支持的后端返回空
+	After    string        // 读取积压消息时从该id之后开始，为空时从头开始
+}
+
+// ClaimArgs 回收空闲消息的参数
+type ClaimArgs struct {
+	Queue    string
+	Shard    int
+	Group    string
+	Consumer string
+	Count    int64
+	MinIdle  time.Duration
+	Held     func(id string) bool // Consumer 本地还持有的消息，不回收
+}
+
+// Driver 队列的存储后端。分片对应后端的分区，消费组对应后端的消费组。
+// 没有设置时使用 Redis Streams，队列描述、重新分片、裁剪、延迟消息、去重和死信队列只有 Redis 支持
+type Driver interface {
+	// Prepare 创建队列的分片和消费组，已经存在时不做修改，group 为空时只创建分片。
+	// DefaultGroup(queue) 从分片中保留的第一条消息开始消费，其他消费组从之后写入的消息开始消费
+	Prepare(queue string, shards int, group string) error
+	// Append 按顺序把一批消息写入分片，返回消息id，后端不返回id时为空字符串
+	Append(queue string, shard int, records []Record) ([]string, error)
+	// ReadGroup 以消费组读取分片中的消息，Block 时间内没有消息时返回空
+	ReadGroup(args *ReadArgs) ([]Record, error)
+	// Ack 确认消息处理完成
+	Ack(queue string, shard int, group string, ids []string) error
+	// Claim 把空闲超过 MinIdle 的消息转移给 Consumer，包括 Consumer 自己没有 ack 的消息，
+	// Held 返回 true 的除外。自动重新投递的后端返回空
+	Claim(args *ClaimArgs) ([]Record, error)
+}
+
+// ConsumerCloser 可以选择实现，消费者关闭并且 ack 完成后对每个优先级的队列调用一次，释放后端为消费者在本地保存的状态
+type ConsumerCloser interface {
+	CloseConsumer(queue string, group string, consumer string)
+}
+
+// BatchReader 可以一次读取多个分片的后端实现，消费者把 hash tag 相同的分片合并读取。
+// args 中除了 Shard、Backlog 和 After 以外的参数都相同，返回的结果和 args 一一对应
+type BatchReader interface {
+	ReadGroups(args []*ReadArgs) ([][]Record, error)
+}
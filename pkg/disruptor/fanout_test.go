@@ -0,0 +1,95 @@
+package disruptor_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sinuxlee/tile/pkg/disruptor"
+	"github.com/sinuxlee/tile/pkg/disruptor/disruptortest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFanOutDeletesAcked(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+
+	newConsumer := func(group string) disruptor.Consumer {
+		cn, err := disruptor.NewConsumer(&disruptor.ConsumerOptions{
+			QueueName: "scores", Consumer: "c1", Group: group, ShardsCount: 1, Block: 10 * time.Millisecond, PipePeriod: 5 * time.Millisecond,
+		}, cli)
+		require.NoError(t, err)
+		return cn
+	}
+
+	main := newConsumer("")
+	defer main.Close()
+	newConsumer("ranking").Close()
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: "scores", ShardsCount: 1, PipePeriod: 5 * time.Millisecond}, cli)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, pr.Push(pr.Value(&order{Seq: i})))
+	}
+	pr.Close()
+
+	length := func() int64 {
+		info, err := disruptor.Inspect(cli, "scores", "", 0)
+		require.NoError(t, err)
+		return info.Length
+	}
+
+	// 默认消费组确认后其他消费组还没有读取，消息保留
+	for i := 0; i < 5; i++ {
+		require.NoError(t, popTimeout(main, func(m disruptor.Message) error { return nil }))
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.EqualValues(t, 5, length())
+
+	// 最后一个消费组确认后删除，没有设置 MaxLen 和 MaxAge 时队列也不会一直增长
+	ranking := newConsumer("ranking")
+	defer ranking.Close()
+	for i := 0; i < 5; i++ {
+		require.NoError(t, popTimeout(ranking, func(m disruptor.Message) error { return nil }))
+	}
+	assert.Eventually(t, func() bool { return length() == 0 }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestFanOutNamedGroupsOnly(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: "events", ShardsCount: 1, PipePeriod: 5 * time.Millisecond}, cli)
+	require.NoError(t, err)
+	defer pr.Close()
+
+	var groups []disruptor.Consumer
+	for _, group := range []string{"analytics", "notify"} {
+		cn, err := disruptor.NewConsumer(&disruptor.ConsumerOptions{
+			QueueName: "events", Consumer: "c1", Group: group, ShardsCount: 1, Block: 10 * time.Millisecond, PipePeriod: 5 * time.Millisecond,
+		}, cli)
+		require.NoError(t, err)
+		defer cn.Close()
+		groups = append(groups, cn)
+	}
+
+	for i := 0; i < 10; i++ {
+		_, err := pr.PushSync(context.Background(), pr.Value(&order{Seq: i}))
+		require.NoError(t, err)
+	}
+
+	for _, cn := range groups {
+		for i := 0; i < 10; i++ {
+			require.NoError(t, popTimeout(cn, func(m disruptor.Message) error { return nil }))
+		}
+	}
+
+	// 只有自定义消费组时不会留下没有消费者的默认消费组，所有消费组确认后删除
+	info, err := disruptor.Inspect(cli, "events", "analytics", 0)
+	require.NoError(t, err)
+	stream := info.Shards[0].Stream
+	assert.Eventually(t, func() bool { return cli.XLen(stream).Val() == 0 }, 2*time.Second, 10*time.Millisecond)
+
+	groupsInfo, err := cli.Do("XINFO", "GROUPS", stream).Result()
+	require.NoError(t, err)
+	assert.Len(t, groupsInfo, 2)
+}
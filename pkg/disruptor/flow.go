@@ -0,0 +1,119 @@
+package disruptor
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// flowPoll 暂停读取时检查本地缓冲的时间间隔
+const flowPoll = 10 * time.Millisecond
+
+// flowControl 消费者的流量控制，limit 是一个 FlowPeriod 内能处理的消息数，
+// 本地缓冲中的消息数达到 limit 时暂停读取，没有达到时每个分片每次读取剩余的部分
+type flowControl struct {
+	handled int64 // 本周期处理完的消息数
+	limit   int64
+}
+
+// buffered 本地缓冲中还没有开始处理的消息数
+func (c *consumer) buffered() int64 {
+	n := len(c.msgChan)
+	for _, ch := range c.laneChans {
+		n += len(ch)
+	}
+
+	return int64(n)
+}
+
+// regulate 定期按处理速度调整 limit。缓冲在周期结束时为空说明读取跟不上处理，limit 加倍，
+// 否则 limit 为这个周期处理的消息数。没有处理任何消息时保持不变
+func (c *consumer) regulate() {
+	tick := time.NewTicker(c.FlowPeriod)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			c.wgCons.Done()
+			return
+		case <-tick.C:
+		}
+
+		handled := atomic.SwapInt64(&c.flow.handled, 0)
+		if handled == 0 {
+			continue
+		}
+
+		limit := handled
+		if c.buffered() == 0 {
+			limit = 2 * atomic.LoadInt64(&c.flow.limit)
+			if limit < 2*handled {
+				limit = 2 * handled
+			}
+		}
+
+		if limit > c.PendingBufferSize {
+			limit = c.PendingBufferSize
+		}
+
+		atomic.StoreInt64(&c.flow.limit, limit)
+	}
+}
+
+// highWater 暂停读取的本地缓冲消息数，为0时不暂停
+func (c *consumer) highWater() int64 {
+	mark := c.HighWaterMark
+	if c.AdaptivePrefetch {
+		if limit := atomic.LoadInt64(&c.flow.limit); mark <= 0 || limit < mark {
+			mark = limit
+		}
+	}
+
+	return mark
+}
+
+// waitLowWater 本地缓冲达到高水位时暂停读取，固定的 HighWaterMark 降到一半以下后恢复，
+// 自适应的高水位降到以下后恢复。开始关闭时返回 false
+func (c *consumer) waitLowWater() bool {
+	mark := c.highWater()
+	if mark <= 0 || c.buffered() < mark {
+		return true
+	}
+
+	tick := time.NewTicker(flowPoll)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return false
+		case <-tick.C:
+		}
+
+		low := c.highWater()
+		if low == c.HighWaterMark {
+			low /= 2
+		}
+
+		if c.buffered() < low || low <= 0 {
+			return true
+		}
+	}
+}
+
+// prefetch 每次从分片读取的数量，自适应时为高水位剩余的部分按分片平分，最少为1，最多为 PrefetchCount
+func (c *consumer) prefetch() int64 {
+	if !c.AdaptivePrefetch {
+		return c.PrefetchCount
+	}
+
+	readers := int64(c.lanes * c.shards())
+	count := (c.highWater() - c.buffered()) / readers
+	if count < 1 {
+		count = 1
+	} else if count > c.PrefetchCount {
+		count = c.PrefetchCount
+	}
+
+	return count
+}
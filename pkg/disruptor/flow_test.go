@@ -0,0 +1,41 @@
+package disruptor_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sinuxlee/tile/pkg/disruptor"
+	"github.com/sinuxlee/tile/pkg/disruptor/disruptortest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlowControl(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: "telemetry", ShardsCount: 1, PipePeriod: 5 * time.Millisecond}, cli)
+	require.NoError(t, err)
+
+	for i := 0; i < 50; i++ {
+		require.NoError(t, pr.Push(pr.Value(&order{Seq: i})))
+	}
+	pr.Close()
+
+	cn, err := disruptor.NewConsumer(&disruptor.ConsumerOptions{
+		QueueName: "telemetry", Consumer: "c1", ShardsCount: 1, Block: 10 * time.Millisecond,
+		PrefetchCount: 10, AdaptivePrefetch: true, FlowPeriod: 20 * time.Millisecond,
+	}, cli)
+	require.NoError(t, err)
+	defer cn.Close()
+
+	// 没有处理消息时读取一次后暂停，PEL 中只有一次读取的消息
+	time.Sleep(100 * time.Millisecond)
+	info, err := disruptor.Inspect(cli, "telemetry", "", 0)
+	require.NoError(t, err)
+	assert.EqualValues(t, 10, info.Pending)
+
+	for i := 0; i < 50; i++ {
+		err, _ := cn.Pop(cn.Value(&order{}), func(m disruptor.Message) error { return nil })
+		require.NoError(t, err)
+	}
+}
@@ -0,0 +1,122 @@
+package disruptor
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 常用的消息头
+const (
+	HeaderContentType     = "content-type"      // 消息体的编码格式
+	HeaderTraceID         = "trace-id"          // 链路追踪id
+	HeaderProducer        = "producer"          // 生产者的节点id
+	HeaderPublishedAt     = "published-at"      // 发布时间，unix 毫秒
+	HeaderSchemaVersion   = "schema-version"    // 消息体的版本
+	HeaderDeliverAt       = "deliver-at"        // 延迟消息的投递时间，unix 毫秒
+	HeaderMessageID       = "message-id"        // 生产者分配的消息id，用于去重
+	HeaderOriginMessageID = "origin-message-id" // 重新发布前的消息id
+	HeaderCorrelationID   = "correlation-id"    // 请求的id，回复中带回同样的值
+	HeaderReplyTo         = "reply-to"          // 请求方接收回复的队列
+	HeaderReplyError      = "reply-error"       // 处理请求失败的原因，设置时回复没有消息体
+	HeaderError           = "error"             // 死信消息的失败原因
+	HeaderAttempts        = "attempts"          // 死信消息的处理次数
+	HeaderOriginID        = "origin-id"         // 死信消息在原队列中的id
+	HeaderOriginStream    = "origin-stream"     // 死信消息所在的原队列
+)
+
+// headerPrefix 消息头在队列中存储时字段名的前缀
+const headerPrefix = "h:"
+
+// Headers 消息的元数据，作为额外的字段和消息体一起存储
+type Headers map[string]string
+
+// Get 获取消息头，不存在时返回空字符串
+func (h Headers) Get(key string) string {
+	return h[key]
+}
+
+// PublishedAt 消息的发布时间，没有发布时间时返回零值
+func (h Headers) PublishedAt() time.Time {
+	ms, err := strconv.ParseInt(h[HeaderPublishedAt], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// PushOption 单条消息的发送选项
+type PushOption func(*outMessage)
+
+// WithHeader 设置一个消息头
+func WithHeader(key, value string) PushOption {
+	return func(m *outMessage) {
+		if m.headers == nil {
+			m.headers = make(Headers)
+		}
+		m.headers[key] = value
+	}
+}
+
+// WithHeaders 设置多个消息头
+func WithHeaders(h Headers) PushOption {
+	return func(m *outMessage) {
+		for k, v := range h {
+			WithHeader(k, v)(m)
+		}
+	}
+}
+
+// WithKey 指定分片的 key，效果和 Marshaler 实现 Keyed 相同
+func WithKey(key string) PushOption {
+	return func(m *outMessage) {
+		m.key = key
+		m.keyed = true
+	}
+}
+
+// encodeFields 把消息体和消息头转换成队列中的字段
+func encodeFields(body []byte, h Headers) map[string]interface{} {
+	values := make(map[string]interface{}, len(h)+1)
+	values[dataField] = body
+	for k, v := range h {
+		values[headerPrefix+k] = v
+	}
+
+	return values
+}
+
+// decodeHeaders 从队列的字段中取出消息头
+func decodeHeaders(values map[string]interface{}) Headers {
+	var h Headers
+	for k, v := range values {
+		if !strings.HasPrefix(k, headerPrefix) {
+			continue
+		}
+
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+
+		if h == nil {
+			h = make(Headers)
+		}
+		h[strings.TrimPrefix(k, headerPrefix)] = s
+	}
+
+	return h
+}
+
+// newMessageID 生成随机的消息id
+func newMessageID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
@@ -0,0 +1,191 @@
+package disruptor
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// MaxShards 分片数量的上限，ShardsCount 为 int8
+const MaxShards = math.MaxInt8
+
+// QueueInfo 队列的消费状态
+type QueueInfo struct {
+	Queue   string      `json:"queue"`
+	Group   string      `json:"group"`
+	Length  int64       `json:"length"`  // 所有分片的消息数
+	Pending int64       `json:"pending"` // 所有分片已读取但还没有ack的消息数
+	Shards  []ShardInfo `json:"shards"`
+}
+
+// ShardInfo 分片队列的消费状态
+type ShardInfo struct {
+	Stream             string         `json:"stream"`
+	Priority           int            `json:"priority"`
+	Length             int64          `json:"length"`
+	LastGeneratedID    string         `json:"lastGeneratedId"`
+	LastDeliveredID    string         `json:"lastDeliveredId"`
+	Pending            int64          `json:"pending"`
+	OldestPendingID    string         `json:"oldestPendingId"`
+	OldestPendingAgeMs int64          `json:"oldestPendingAgeMs"` // 最早未ack的消息写入至今的毫秒数
+	Consumers          []ConsumerInfo `json:"consumers"`
+}
+
+// ConsumerInfo 消费者的状态
+type ConsumerInfo struct {
+	Name    string `json:"name"`
+	Pending int64  `json:"pending"`
+	IdleMs  int64  `json:"idleMs"` // 距离上次读取的毫秒数
+}
+
+// Inspect 查询队列各个优先级各个分片的长度、PEL 大小和消费组中消费者的状态，只读不会修改队列。
+// group 为空时查询默认消费组，shards <= 0 时使用队列描述中的分片数量。
+// shards 超过队列描述中的分片数量，或者没有队列描述时超过 MaxShards 返回 ErrTooManyShards
+func Inspect(cli redis.UniversalClient, queue string, group string, shards int) (*QueueInfo, error) {
+	if group == "" {
+		group = makeGroupName(queue)
+	}
+
+	desc, err := readOrLegacyDescriptor(cli, queue, shards > 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if shards <= 0 {
+		shards = desc.Shards
+	}
+
+	if shards > MaxShards || (desc.Shards > 0 && shards > desc.Shards) {
+		return nil, ErrTooManyShards
+	}
+
+	info := &QueueInfo{
+		Queue:  queue,
+		Group:  group,
+		Shards: make([]ShardInfo, 0, desc.Lanes*shards),
+	}
+
+	for lane := 0; lane < desc.Lanes; lane++ {
+		laneQueue := makeLaneName(queue, lane)
+		for i := 0; i < shards; i++ {
+			shard, err := inspectShard(cli, desc.streamName(laneQueue, i), makeLaneGroup(queue, group, lane))
+			if err != nil {
+				return nil, err
+			}
+
+			shard.Priority = lane
+			info.Length += shard.Length
+			info.Pending += shard.Pending
+			info.Shards = append(info.Shards, *shard)
+		}
+	}
+
+	return info, nil
+}
+
+// inspectShard 分片在第一次写入或者创建消费组时创建，还没有创建的分片和消费组返回空的状态
+func inspectShard(cli redis.UniversalClient, stream string, group string) (*ShardInfo, error) {
+	shard := &ShardInfo{Stream: stream}
+
+	if n, err := cli.Exists(stream).Result(); err != nil || n == 0 {
+		return shard, err
+	}
+
+	// go-redis 内置的 XINFO 解析不兼容新版本 Redis 增加的字段，这里按键值对解析
+	xinfo := redis.NewSliceCmd("XINFO", "STREAM", stream)
+	if err := cli.Process(xinfo); err != nil {
+		return nil, err
+	}
+
+	fields := infoFields(xinfo.Val())
+	shard.Length = infoInt(fields["length"])
+	shard.LastGeneratedID = infoString(fields["last-generated-id"])
+
+	groups := redis.NewSliceCmd("XINFO", "GROUPS", stream)
+	if err := cli.Process(groups); err != nil {
+		return nil, err
+	}
+
+	found := false
+	for _, g := range groups.Val() {
+		fields := infoFields(g)
+		if infoString(fields["name"]) == group {
+			shard.LastDeliveredID = infoString(fields["last-delivered-id"])
+			found = true
+		}
+	}
+
+	if !found {
+		return shard, nil
+	}
+
+	consumers := redis.NewSliceCmd("XINFO", "CONSUMERS", stream, group)
+	if err := cli.Process(consumers); err != nil {
+		return nil, err
+	}
+
+	for _, c := range consumers.Val() {
+		fields := infoFields(c)
+		shard.Consumers = append(shard.Consumers, ConsumerInfo{
+			Name:    infoString(fields["name"]),
+			Pending: infoInt(fields["pending"]),
+			IdleMs:  infoInt(fields["idle"]),
+		})
+	}
+
+	pending, err := cli.XPending(stream, group).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	if pending != nil && pending.Count > 0 {
+		shard.Pending = pending.Count
+		shard.OldestPendingID = pending.Lower
+		shard.OldestPendingAgeMs = time.Since(idTime(pending.Lower)).Nanoseconds() / int64(time.Millisecond)
+	}
+
+	return shard, nil
+}
+
+// idTime 消息id的前半部分是写入时的毫秒时间戳
+func idTime(id string) time.Time {
+	ms, err := strconv.ParseInt(strings.SplitN(id, "-", 2)[0], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// infoFields 把 XINFO 返回的键值对列表转换成 map
+func infoFields(v interface{}) map[string]interface{} {
+	list, _ := v.([]interface{})
+	fields := make(map[string]interface{}, len(list)/2)
+	for i := 0; i+1 < len(list); i += 2 {
+		if key, ok := list[i].(string); ok {
+			fields[key] = list[i+1]
+		}
+	}
+
+	return fields
+}
+
+func infoString(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+func infoInt(v interface{}) int64 {
+	switch n := v.(type) {
+	case int64:
+		return n
+	case string:
+		i, _ := strconv.ParseInt(n, 10, 64)
+		return i
+	}
+
+	return 0
+}
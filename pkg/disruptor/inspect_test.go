@@ -0,0 +1,82 @@
+package disruptor_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/sinuxlee/tile/pkg/disruptor"
+	"github.com/sinuxlee/tile/pkg/disruptor/disruptortest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspectShardsLimit(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: "inspect", ShardsCount: 2}, cli)
+	require.NoError(t, err)
+	pr.Close()
+
+	info, err := disruptor.Inspect(cli, "inspect", "", 2)
+	require.NoError(t, err)
+	assert.Len(t, info.Shards, 2)
+
+	_, err = disruptor.Inspect(cli, "inspect", "", 3)
+	assert.Equal(t, disruptor.ErrTooManyShards, err)
+
+	// 没有队列描述时不能超过 MaxShards
+	_, err = disruptor.Inspect(cli, "missing", "", disruptor.MaxShards+1)
+	assert.Equal(t, disruptor.ErrTooManyShards, err)
+}
+
+func TestInspectState(t *testing.T) {
+	mr, cli := disruptortest.NewRedis(t)
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: "inspected", ShardsCount: 2}, cli)
+	require.NoError(t, err)
+	pr.Close()
+
+	empty, err := disruptor.Inspect(cli, "inspected", "g", 0)
+	require.NoError(t, err)
+	require.Len(t, empty.Shards, 2)
+	first, second := empty.Shards[0].Stream, empty.Shards[1].Stream
+
+	// 第一个分片写入 3 条 5 秒前到 3 秒前的消息，第二个分片写入 1 条
+	now := time.Now()
+	written := now.Add(-5*time.Second).UnixNano() / int64(time.Millisecond)
+	for i := int64(0); i < 3; i++ {
+		require.NoError(t, cli.XAdd(&redis.XAddArgs{Stream: first, ID: fmt.Sprintf("%v-0", written+i*1000), Values: map[string]interface{}{"data": "x"}}).Err())
+	}
+	require.NoError(t, cli.XAdd(&redis.XAddArgs{Stream: second, Values: map[string]interface{}{"data": "x"}}).Err())
+
+	// c1 读取第一个分片的 2 条消息不 ack，3 秒后查询。miniredis 只在 XCLAIM 时更新消费者的 idle
+	require.NoError(t, cli.XGroupCreate(first, "g", "0").Err())
+	mr.SetTime(now)
+	ids, err := cli.XReadGroup(&redis.XReadGroupArgs{Group: "g", Consumer: "c1", Streams: []string{first, ">"}, Count: 2}).Result()
+	require.NoError(t, err)
+	require.NoError(t, cli.XClaim(&redis.XClaimArgs{Stream: first, Group: "g", Consumer: "c1", Messages: []string{ids[0].Messages[0].ID}}).Err())
+	mr.SetTime(now.Add(3 * time.Second))
+
+	info, err := disruptor.Inspect(cli, "inspected", "g", 0)
+	require.NoError(t, err)
+	assert.Equal(t, "g", info.Group)
+	assert.Equal(t, int64(4), info.Length)
+	assert.Equal(t, int64(2), info.Pending)
+
+	shard := info.Shards[0]
+	assert.Equal(t, first, shard.Stream)
+	assert.Equal(t, int64(3), shard.Length)
+	assert.Equal(t, fmt.Sprintf("%v-0", written+1000), shard.LastDeliveredID)
+	assert.Equal(t, int64(2), shard.Pending)
+	assert.Equal(t, fmt.Sprintf("%v-0", written), shard.OldestPendingID)
+	assert.InDelta(t, time.Since(now.Add(-5*time.Second)).Milliseconds(), shard.OldestPendingAgeMs, 1000)
+	require.Len(t, shard.Consumers, 1)
+	assert.Equal(t, disruptor.ConsumerInfo{Name: "c1", Pending: 2, IdleMs: 3000}, shard.Consumers[0])
+
+	// 第二个分片还没有创建消费组，只有长度
+	assert.Equal(t, int64(1), info.Shards[1].Length)
+	assert.Zero(t, info.Shards[1].Pending)
+	assert.Empty(t, info.Shards[1].Consumers)
+}
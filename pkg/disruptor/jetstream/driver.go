@@ -0,0 +1,325 @@
+// Package jetstream 基于 NATS JetStream 的 disruptor 后端。
+// 每个队列是一个 stream，分片是 stream 中的 subject，消费组的每个分片是一个 durable pull consumer。
+// 同一个消费组的消费者共用 durable consumer，ConsumerOptions.Consumer 不会传给服务端，
+// 只用来区分本地保存的还没有 ack 的消息
+package jetstream
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imdario/mergo"
+	"github.com/nats-io/nats.go"
+	"github.com/sinuxlee/tile/pkg/disruptor"
+)
+
+// minWait 拉取消息的最短等待时间，太短时服务端来不及响应
+const minWait = 50 * time.Millisecond
+
+// Options JetStream 后端的配置
+type Options struct {
+	// 消息投递后超过该时间没有ack时重新投递给同组的消费者
+	AckWait time.Duration
+	// stream 的副本数
+	Replicas int
+	// stream 使用的存储
+	Storage nats.StorageType
+}
+
+var defaultOptions = Options{
+	AckWait:  30 * time.Second,
+	Replicas: 1,
+	Storage:  nats.FileStorage,
+}
+
+// driver 实现 disruptor.Driver，读取到还没有ack的消息保存在 pending 中，ack 时通过原消息确认
+type driver struct {
+	js  nats.JetStreamContext
+	opt Options
+
+	mu      sync.Mutex
+	subs    map[string]*nats.Subscription
+	pending map[string]*pendingMsg
+	swept   time.Time // 上次清理 pending 的时间
+}
+
+// pendingMsg 读取到还没有ack的消息
+type pendingMsg struct {
+	msg      *nats.Msg
+	queue    string
+	group    string
+	consumer string
+	read     time.Time
+}
+
+// New 创建 JetStream 后端，通过 ProducerOptions.Driver 和 ConsumerOptions.Driver 使用
+func New(js nats.JetStreamContext, opt *Options) (disruptor.Driver, error) {
+	o := Options{}
+	if opt != nil {
+		o = *opt
+	}
+
+	if err := mergo.Merge(&o, defaultOptions); err != nil {
+		return nil, err
+	}
+
+	return &driver{
+		js:      js,
+		opt:     o,
+		subs:    make(map[string]*nats.Subscription),
+		pending: make(map[string]*pendingMsg),
+	}, nil
+}
+
+func (d *driver) Prepare(queue string, shards int, group string) error {
+	stream := streamName(queue)
+	if _, err := d.js.StreamInfo(stream); err != nil {
+		_, err = d.js.AddStream(&nats.StreamConfig{
+			Name:     stream,
+			Subjects: []string{fmt.Sprintf("disruptor.%v.*", sanitize(queue))},
+			Storage:  d.opt.Storage,
+			Replicas: d.opt.Replicas,
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if group == "" {
+		return nil
+	}
+
+	// 默认消费组从第一条消息开始消费，其他新的消费组从之后写入的消息开始消费
+	policy := nats.DeliverNewPolicy
+	if group == disruptor.DefaultGroup(queue) {
+		policy = nats.DeliverAllPolicy
+	}
+
+	for i := 0; i < shards; i++ {
+		durable := durableName(group, i)
+		if _, err := d.js.ConsumerInfo(stream, durable); err == nil {
+			continue
+		}
+
+		_, err := d.js.AddConsumer(stream, &nats.ConsumerConfig{
+			Durable:       durable,
+			DeliverPolicy: policy,
+			AckPolicy:     nats.AckExplicitPolicy,
+			AckWait:       d.opt.AckWait,
+			FilterSubject: subjectName(queue, i),
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *driver) Append(queue string, shard int, records []disruptor.Record) ([]string, error) {
+	subject := subjectName(queue, shard)
+	futures := make([]nats.PubAckFuture, len(records))
+	for i, r := range records {
+		m := nats.NewMsg(subject)
+		m.Data = r.Body
+		for k, v := range r.Headers {
+			m.Header[k] = []string{v}
+		}
+
+		f, err := d.js.PublishMsgAsync(m)
+		if err != nil {
+			return nil, err
+		}
+
+		futures[i] = f
+	}
+
+	// 同一个连接上的异步发布按顺序写入
+	ids := make([]string, len(futures))
+	for i, f := range futures {
+		select {
+		case ack := <-f.Ok():
+			ids[i] = strconv.FormatUint(ack.Sequence, 10)
+		case err := <-f.Err():
+			return nil, err
+		}
+	}
+
+	return ids, nil
+}
+
+func (d *driver) ReadGroup(args *disruptor.ReadArgs) ([]disruptor.Record, error) {
+	// 没有ack的消息在 AckWait 之后由服务端重新投递，不需要单独读取
+	if args.Backlog {
+		return nil, nil
+	}
+
+	sub, err := d.subscribe(args.Queue, args.Shard, args.Group)
+	if err != nil {
+		return nil, err
+	}
+
+	wait := args.Block
+	if wait < minWait {
+		wait = minWait
+	}
+
+	msgs, err := sub.Fetch(int(args.Count), nats.MaxWait(wait))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	d.sweep(now)
+
+	if err != nil {
+		if err == nats.ErrTimeout {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	// 重新投递的消息覆盖之前保存的同一条消息
+	records := make([]disruptor.Record, 0, len(msgs))
+	for _, m := range msgs {
+		meta, err := m.Metadata()
+		if err != nil {
+			return records, err
+		}
+
+		id := strconv.FormatUint(meta.Sequence.Stream, 10)
+		d.pending[pendingKey(args.Queue, args.Shard, args.Group, id)] = &pendingMsg{
+			msg: m, queue: args.Queue, group: args.Group, consumer: args.Consumer, read: now,
+		}
+		records = append(records, decodeRecord(id, m))
+	}
+
+	return records, nil
+}
+
+// sweep 每个 AckWait 清理一次超过 AckWait 还没有 ack 的消息，服务端已经把它们重新投递，
+// 可能投递给了其他进程，之后对它们的 ack 被忽略
+func (d *driver) sweep(now time.Time) {
+	if now.Sub(d.swept) < d.opt.AckWait {
+		return
+	}
+
+	d.swept = now
+	for key, p := range d.pending {
+		if now.Sub(p.read) >= d.opt.AckWait {
+			delete(d.pending, key)
+		}
+	}
+}
+
+// CloseConsumer 删除消费者还没有ack的消息，它们由服务端在 AckWait 之后重新投递
+func (d *driver) CloseConsumer(queue string, group string, consumer string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for key, p := range d.pending {
+		if p.queue == queue && p.group == group && p.consumer == consumer {
+			delete(d.pending, key)
+		}
+	}
+}
+
+// subscribe 返回绑定到消费组分片的 pull subscription，同一个消费组的消费者共用
+func (d *driver) subscribe(queue string, shard int, group string) (*nats.Subscription, error) {
+	durable := durableName(group, shard)
+	key := queue + "/" + durable
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if sub, ok := d.subs[key]; ok {
+		return sub, nil
+	}
+
+	sub, err := d.js.PullSubscribe(subjectName(queue, shard), durable, nats.BindStream(streamName(queue)))
+	if err != nil {
+		return nil, err
+	}
+
+	d.subs[key] = sub
+	return sub, nil
+}
+
+// Ack 逐条 ack，失败的消息也从 pending 中删除，由服务端超时后重新投递。返回合并后的错误
+func (d *driver) Ack(queue string, shard int, group string, ids []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var errs []string
+	for _, id := range ids {
+		key := pendingKey(queue, shard, group, id)
+		p, ok := d.pending[key]
+		if !ok {
+			continue
+		}
+
+		delete(d.pending, key)
+		if err := p.msg.Ack(); err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", id, err))
+		}
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("jetstream: ack %v of %v messages failed: %v", len(errs), len(ids), strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// Claim 超时没有ack的消息由服务端重新投递
+func (d *driver) Claim(args *disruptor.ClaimArgs) ([]disruptor.Record, error) {
+	return nil, nil
+}
+
+func decodeRecord(id string, m *nats.Msg) disruptor.Record {
+	r := disruptor.Record{ID: id, Body: m.Data, Headers: make(disruptor.Headers, len(m.Header))}
+	if r.Body == nil {
+		r.Body = []byte{}
+	}
+
+	for k, v := range m.Header {
+		if len(v) != 0 {
+			r.Headers[k] = v[0]
+		}
+	}
+
+	return r
+}
+
+// sanitize stream、subject 和 consumer 的名字中不能有 . * > 和空白字符
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\n', '\r':
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+func streamName(queue string) string {
+	return "DISRUPTOR_" + sanitize(queue)
+}
+
+func subjectName(queue string, shard int) string {
+	return fmt.Sprintf("disruptor.%v.%v", sanitize(queue), shard)
+}
+
+func durableName(group string, shard int) string {
+	return fmt.Sprintf("%v_%v", sanitize(group), shard)
+}
+
+func pendingKey(queue string, shard int, group string, id string) string {
+	return fmt.Sprintf("%v/%v/%v/%v", queue, shard, group, id)
+}
@@ -0,0 +1,124 @@
+package jetstream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/sinuxlee/tile/pkg/disruptor"
+	"github.com/sinuxlee/tile/pkg/disruptor/disruptortest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connect 启动进程内开启 JetStream 的 nats-server，测试结束时关闭
+func connect(t testing.TB) *nats.Conn {
+	s, err := server.NewServer(&server.Options{Port: -1, JetStream: true, StoreDir: t.TempDir()})
+	require.NoError(t, err)
+
+	go s.Start()
+	require.True(t, s.ReadyForConnections(5*time.Second), "nats-server not ready")
+
+	nc, err := nats.Connect(s.ClientURL())
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		nc.Close()
+		s.Shutdown()
+	})
+
+	return nc
+}
+
+// backend 使用进程内 nats-server 的 JetStream 后端
+func backend(t testing.TB) disruptortest.Backend {
+	js, err := connect(t).JetStream()
+	require.NoError(t, err)
+
+	// 重新投递的时间缩短，积压消息的测试才能在超时前收到
+	drv, err := New(js, &Options{AckWait: time.Second})
+	require.NoError(t, err)
+
+	return disruptortest.Backend{
+		Name: "jetstream",
+		NewProducer: func(opt *disruptor.ProducerOptions) (disruptor.Producer, error) {
+			opt.Driver = drv
+			return disruptor.NewProducer(opt, nil)
+		},
+		NewConsumer: func(opt *disruptor.ConsumerOptions) (disruptor.Consumer, error) {
+			opt.Driver = drv
+			return disruptor.NewConsumer(opt, nil)
+		},
+	}
+}
+
+func TestJetStream(t *testing.T) {
+	disruptortest.Run(t, backend)
+}
+
+func TestAckAll(t *testing.T) {
+	nc := connect(t)
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+
+	drv, err := New(js, nil)
+	require.NoError(t, err)
+
+	d := drv.(*driver)
+	require.NoError(t, d.Prepare("acks", 1, "g"))
+
+	ids, err := d.Append("acks", 0, []disruptor.Record{{Body: []byte("1")}, {Body: []byte("2")}})
+	require.NoError(t, err)
+
+	records, err := d.ReadGroup(&disruptor.ReadArgs{Queue: "acks", Group: "g", Consumer: "c1", Count: 2, Block: time.Second})
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+
+	// 连接断开后每条消息的 ack 都失败，错误全部返回，pending 全部清理
+	nc.Close()
+	err = d.Ack("acks", 0, "g", ids)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "2 of 2")
+	assert.Empty(t, d.pending)
+}
+
+func TestPendingCleared(t *testing.T) {
+	js, err := connect(t).JetStream()
+	require.NoError(t, err)
+
+	drv, err := New(js, &Options{AckWait: 200 * time.Millisecond})
+	require.NoError(t, err)
+
+	d := drv.(*driver)
+	require.NoError(t, d.Prepare("stale", 1, "g"))
+	_, err = d.Append("stale", 0, []disruptor.Record{{Body: []byte("1")}})
+	require.NoError(t, err)
+
+	// 之后创建的消费组读不到已经写入的消息
+	require.NoError(t, d.Prepare("stale", 1, "idle"))
+
+	read := func(group string) []disruptor.Record {
+		records, err := d.ReadGroup(&disruptor.ReadArgs{Queue: "stale", Group: group, Consumer: "c1", Count: 1, Block: 100 * time.Millisecond})
+		require.NoError(t, err)
+		return records
+	}
+
+	// 关闭消费者时删除它没有 ack 的消息
+	require.Len(t, read("g"), 1)
+	require.Len(t, d.pending, 1)
+	d.CloseConsumer("stale", "g", "c2")
+	assert.Len(t, d.pending, 1)
+	d.CloseConsumer("stale", "g", "c1")
+	assert.Empty(t, d.pending)
+
+	// 超过 AckWait 后服务端重新投递，重新投递的消息覆盖原来的消息
+	time.Sleep(250 * time.Millisecond)
+	require.Len(t, read("g"), 1)
+	require.Len(t, d.pending, 1)
+
+	// 重新投递给其他进程的消息在下一个 AckWait 清理
+	time.Sleep(250 * time.Millisecond)
+	assert.Empty(t, read("idle"))
+	assert.Empty(t, d.pending)
+}
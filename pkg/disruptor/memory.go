@@ -0,0 +1,511 @@
+package disruptor
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/imdario/mergo"
+)
+
+// MemoryBroker 内存中的队列，分片、消费组、ack 和积压消息的语义和 Redis 的实现相同，
+// 用于没有 Redis 的单元测试。不支持裁剪、去重、重新分片和回收其他消费者的消息
+type MemoryBroker struct {
+	mu      sync.Mutex
+	queues  map[string]*memQueue
+	streams map[string]*memStream
+}
+
+// memQueue 相当于 Redis 中的队列描述
+type memQueue struct {
+	shards int
+	codec  string
+}
+
+type memStream struct {
+	entries []*memEntry // 按写入顺序排列，删除的消息只做标记
+	index   map[string]int
+	groups  map[string]*memGroup
+	lastMs  int64
+	seq     int64
+	notify  chan struct{} // 有新消息时关闭并重新创建
+}
+
+type memEntry struct {
+	id      string
+	body    []byte
+	headers Headers
+	deleted bool
+}
+
+type memGroup struct {
+	next    int               // 下一条没有投递的消息
+	pending map[string]string // 已经投递还没有ack的消息id和所属的消费者
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		queues:  make(map[string]*memQueue),
+		streams: make(map[string]*memStream),
+	}
+}
+
+// queue 第一次使用时创建队列的分片，之后以创建时的分片数量为准
+func (b *MemoryBroker) queue(name string, shards int, codec string) (*memQueue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[name]
+	if !ok {
+		q = &memQueue{shards: shards, codec: codec}
+		b.queues[name] = q
+
+		for i := 0; i < shards; i++ {
+			b.stream(makeStreamName(name, "", i))
+		}
+	}
+
+	if q.codec != codec {
+		return nil, fmt.Errorf("%w: queue %v uses %v, got %v", ErrCodecMismatch, name, q.codec, codec)
+	}
+
+	return q, nil
+}
+
+func (b *MemoryBroker) stream(name string) *memStream {
+	s, ok := b.streams[name]
+	if !ok {
+		s = &memStream{
+			index:  make(map[string]int),
+			groups: make(map[string]*memGroup),
+			notify: make(chan struct{}),
+		}
+		b.streams[name] = s
+	}
+
+	return s
+}
+
+// createGroup 消费组已经存在时不做修改。和 Redis 的实现一样，默认消费组从第一条消息开始消费，
+// 其他消费组从之后写入的消息开始消费
+func (b *MemoryBroker) createGroup(stream string, group string, fromStart bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := b.stream(stream)
+	if _, ok := s.groups[group]; !ok && fromStart {
+		s.groups[group] = &memGroup{pending: make(map[string]string)}
+	}
+
+	s.group(group)
+}
+
+func (b *MemoryBroker) append(stream string, body []byte, headers Headers) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.stream(stream).append(body, headers)
+}
+
+// read 读取消息，from 大于等于0时从该位置开始读取已经投递给 consumer 还没有ack的消息，
+// 小于0时读取新消息。返回消息、下次读取积压消息的位置和等待新消息的通道
+func (b *MemoryBroker) read(stream string, group string, consumer string, count int, from int) ([]*memEntry, int, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := b.stream(stream)
+	g := s.group(group)
+
+	var res []*memEntry
+	if from >= 0 {
+		for ; from < len(s.entries) && len(res) < count; from++ {
+			e := s.entries[from]
+			if !e.deleted && g.pending[e.id] == consumer {
+				res = append(res, e)
+			}
+		}
+
+		return res, from, s.notify
+	}
+
+	for ; g.next < len(s.entries) && len(res) < count; g.next++ {
+		e := s.entries[g.next]
+		if e.deleted {
+			continue
+		}
+
+		g.pending[e.id] = consumer
+		res = append(res, e)
+	}
+
+	return res, from, s.notify
+}
+
+// ack 从消费组的待确认列表中移除，del 为 true 并且所有消费组都已经读取并确认时同时删除消息
+func (b *MemoryBroker) ack(stream string, group string, id string, del bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := b.stream(stream)
+	delete(s.group(group).pending, id)
+
+	i, ok := s.index[id]
+	if !ok || !del {
+		return
+	}
+
+	for _, g := range s.groups {
+		if _, pending := g.pending[id]; pending || g.next <= i {
+			return
+		}
+	}
+
+	s.entries[i].deleted = true
+	delete(s.index, id)
+}
+
+// Len 分片队列中没有删除的消息数
+func (b *MemoryBroker) Len(queue string, shard int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.stream(makeStreamName(queue, "", shard)).index)
+}
+
+// DeadLetters 死信队列中的消息，和 Redis 的死信队列一样在消息头中记录失败原因、处理次数和原队列中的位置
+func (b *MemoryBroker) DeadLetters(queue string) []Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stream := makeDeadLetterName(queue)
+	var res []Message
+	for _, e := range b.stream(stream).entries {
+		if !e.deleted {
+			res = append(res, Message{ID: e.id, Stream: stream, Body: e.body, Headers: e.headers})
+		}
+	}
+
+	return res
+}
+
+func (s *memStream) group(name string) *memGroup {
+	g, ok := s.groups[name]
+	if !ok {
+		g = &memGroup{next: len(s.entries), pending: make(map[string]string)}
+		s.groups[name] = g
+	}
+
+	return g
+}
+
+// append 和 Redis 一样生成 "毫秒-序号" 格式的递增id
+func (s *memStream) append(body []byte, headers Headers) string {
+	ms := time.Now().UnixNano() / int64(time.Millisecond)
+	if ms > s.lastMs {
+		s.lastMs = ms
+		s.seq = 0
+	} else {
+		s.seq++
+	}
+
+	id := strconv.FormatInt(s.lastMs, 10) + "-" + strconv.FormatInt(s.seq, 10)
+	s.index[id] = len(s.entries)
+	s.entries = append(s.entries, &memEntry{id: id, body: body, headers: headers})
+
+	close(s.notify)
+	s.notify = make(chan struct{})
+
+	return id
+}
+
+type memProducer struct {
+	*ProducerOptions
+	broker *MemoryBroker
+	queue  *memQueue
+	rr     uint32 // 没有 key 的消息轮流发往各个分片
+	closed int32
+}
+
+// NewMemoryProducer 创建写入 broker 的生产者，消息直接写入，不经过本地缓冲。
+// 不支持优先级、裁剪、发送重试、本地文件和延迟消息的转移，设置了这些选项时返回 ErrNotSupported
+func NewMemoryProducer(opt *ProducerOptions, broker *MemoryBroker) (Producer, error) {
+	if err := mergo.Merge(opt, defaultProducerOptions); err != nil {
+		return nil, err
+	}
+
+	if opt.Priorities > 1 || opt.MaxLen > 0 || opt.MaxAge > 0 || opt.SendRetries > 0 || opt.SpillDir != "" || opt.MoveDelayed {
+		return nil, ErrNotSupported
+	}
+
+	q, err := broker.queue(opt.QueueName, int(opt.ShardsCount), opt.Codec.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	return &memProducer{ProducerOptions: opt, broker: broker, queue: q}, nil
+}
+
+func (p *memProducer) Close() {
+	_, _ = p.CloseContext(context.Background())
+}
+
+func (p *memProducer) CloseContext(ctx context.Context) (int, error) {
+	atomic.StoreInt32(&p.closed, 1)
+	return 0, nil
+}
+
+func (p *memProducer) Push(data Marshaler, opts ...PushOption) error {
+	_, err := p.send(data, nil, opts)
+	return err
+}
+
+func (p *memProducer) PushContext(ctx context.Context, data Marshaler, opts ...PushOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	_, err := p.send(data, nil, opts)
+	return err
+}
+
+func (p *memProducer) TryPush(data Marshaler, opts ...PushOption) error {
+	_, err := p.send(data, nil, opts)
+	return err
+}
+
+func (p *memProducer) PushConfirm(data Marshaler, cb ConfirmFunc, opts ...PushOption) error {
+	_, err := p.send(data, cb, opts)
+	return err
+}
+
+func (p *memProducer) PushSync(ctx context.Context, data Marshaler, opts ...PushOption) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	return p.send(data, nil, opts)
+}
+
+func (p *memProducer) Value(v interface{}) Marshaler {
+	return &codecValue{codec: p.Codec, v: v}
+}
+
+func (p *memProducer) PushAt(at time.Time, data Marshaler, opts ...PushOption) error {
+	if atomic.LoadInt32(&p.closed) != 0 {
+		return ErrClosed
+	}
+
+	m, err := makeOutMessage(p.NodeID, data, nil, opts)
+	if err != nil {
+		return err
+	}
+
+	WithHeader(HeaderDeliverAt, strconv.FormatInt(at.UnixNano()/int64(time.Millisecond), 10))(m)
+
+	// 和 Redis 的实现一样，生产者关闭后到期的延迟消息照常写入
+	time.AfterFunc(time.Until(at), func() {
+		p.append(m)
+	})
+
+	return nil
+}
+
+func (p *memProducer) PushAfter(d time.Duration, data Marshaler, opts ...PushOption) error {
+	return p.PushAt(time.Now().Add(d), data, opts...)
+}
+
+func (p *memProducer) send(data Marshaler, cb ConfirmFunc, opts []PushOption) (string, error) {
+	if atomic.LoadInt32(&p.closed) != 0 {
+		return "", ErrClosed
+	}
+
+	m, err := makeOutMessage(p.NodeID, data, cb, opts)
+	if err != nil {
+		return "", err
+	}
+
+	p.Metrics.Pushed(p.QueueName)
+	id := p.append(m)
+	if m.done != nil {
+		m.done(id, nil)
+	}
+
+	return id, nil
+}
+
+func (p *memProducer) append(m *outMessage) string {
+	shard := int(atomic.AddUint32(&p.rr, 1) % uint32(p.queue.shards))
+	if m.keyed {
+		shard = shardOf(m.key, p.queue.shards)
+	}
+
+	id := p.broker.append(makeStreamName(p.QueueName, "", shard), m.body, m.headers)
+	p.Metrics.Sent(p.QueueName, 0, shard, 1, 0)
+
+	return id
+}
+
+type memConsumer struct {
+	*ConsumerOptions
+	broker   *MemoryBroker
+	queue    *memQueue
+	msgChan  chan Message
+	done     chan struct{}
+	emitter  ErrorNotifier
+	wgCons   *sync.WaitGroup
+	inflight *sync.WaitGroup
+}
+
+// NewMemoryConsumer 创建从 broker 读取的消费者，同名消费者重新创建后先收到之前没有ack的消息。
+// 不支持优先级、去重、回收、延迟消息和流量控制，设置了这些选项时返回 ErrNotSupported
+func NewMemoryConsumer(opt *ConsumerOptions, broker *MemoryBroker) (Consumer, error) {
+	if err := mergo.Merge(opt, defaultConsumerOptions); err != nil {
+		return nil, err
+	}
+
+	if opt.Priorities > 1 || opt.DedupWindow > 0 || opt.ClaimMinIdle > 0 || opt.MoveDelayed ||
+		opt.AdaptivePrefetch || opt.HighWaterMark > 0 {
+		return nil, ErrNotSupported
+	}
+
+	if opt.Group == "" {
+		opt.Group = makeGroupName(opt.QueueName)
+	}
+
+	q, err := broker.queue(opt.QueueName, int(opt.ShardsCount), opt.Codec.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	cn := &memConsumer{
+		ConsumerOptions: opt,
+		broker:          broker,
+		queue:           q,
+		msgChan:         make(chan Message, opt.PendingBufferSize),
+		done:            make(chan struct{}),
+		emitter:         opt.ErrorNotifier,
+		wgCons:          &sync.WaitGroup{},
+		inflight:        &sync.WaitGroup{},
+	}
+
+	for i := 0; i < q.shards; i++ {
+		broker.createGroup(makeStreamName(opt.QueueName, "", i), opt.Group, opt.Group == makeGroupName(opt.QueueName))
+
+		cn.wgCons.Add(1)
+		go cn.consume(i)
+	}
+
+	return cn, nil
+}
+
+func (c *memConsumer) Pop(data Marshaler, h Handler) (error, bool) {
+	return c.PopContext(context.Background(), data, h)
+}
+
+func (c *memConsumer) PopContext(ctx context.Context, data Marshaler, h Handler) (error, bool) {
+	return popMessage(ctx, c.msgChan, data, h, c.handle)
+}
+
+func (c *memConsumer) Run(ctx context.Context, workers int, factory func() Marshaler, h Handler) error {
+	return runWorkers(ctx, workers, c.msgChan, factory, h, c.handle, c.release, c.emitter)
+}
+
+func (c *memConsumer) Value(v interface{}) Marshaler {
+	return &codecValue{codec: c.Codec, v: v}
+}
+
+func (c *memConsumer) Close() {
+	close(c.done)
+
+	c.wgCons.Wait()
+	close(c.msgChan)
+
+	// 丢弃还没有开始处理的消息，它们留在待确认列表中，同名消费者重新创建后再次投递
+	for m := range c.msgChan {
+		c.release(m)
+	}
+	c.inflight.Wait()
+}
+
+// release 丢弃还没有开始处理的消息，消息留在待确认列表中
+func (c *memConsumer) release(m Message) {
+	c.inflight.Done()
+}
+
+func (c *memConsumer) consume(shard int) {
+	defer c.wgCons.Done()
+
+	stream := makeStreamName(c.QueueName, "", shard)
+	from := 0 // 先读取积压的消息，读完后为 -1
+
+	for {
+		entries, next, notify := c.broker.read(stream, c.Group, c.Consumer, int(c.PrefetchCount), from)
+		if len(entries) == 0 {
+			if from >= 0 {
+				from = -1
+				continue
+			}
+
+			select {
+			case <-notify:
+				continue
+			case <-c.done:
+				return
+			}
+		}
+
+		c.Metrics.Received(c.QueueName, 0, shard, len(entries))
+		for _, e := range entries {
+			msg := Message{
+				ID:      e.id,
+				Stream:  stream,
+				Group:   c.Group,
+				Body:    e.body,
+				Headers: e.headers,
+				shard:   shard,
+			}
+
+			c.inflight.Add(1)
+			select {
+			case c.msgChan <- msg:
+			case <-c.done:
+				c.inflight.Done()
+				return
+			}
+		}
+
+		from = next
+	}
+}
+
+// handle 和 Redis 的实现一样重试和写入死信队列，ack 直接生效
+func (c *memConsumer) handle(m Message, data Marshaler, h Handler) error {
+	defer c.inflight.Done()
+
+	m, err := decodeMessage(m, data)
+	if err != nil {
+		c.fail(m, err, 1)
+		return err
+	}
+
+	return retryMessage(m, h, &c.Retry, c.ack, c.fail)
+}
+
+func (c *memConsumer) fail(m Message, cause error, attempts int) {
+	c.Metrics.HandleFailed(c.QueueName, m.lane, m.shard)
+
+	if c.DeadLetter {
+		c.broker.append(makeDeadLetterName(c.QueueName), m.Body, deadLetterHeaders(m, cause, attempts))
+	}
+
+	c.ack(m)
+}
+
+func (c *memConsumer) ack(m Message) {
+	// 和 Redis 的实现一样，所有消费组都确认后删除消息，KeepAcked 时保留
+	c.broker.ack(m.Stream, m.Group, m.ID, !c.KeepAcked)
+	c.Metrics.Acked(c.QueueName, m.lane, m.shard, 1, 0)
+}
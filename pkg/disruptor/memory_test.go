@@ -0,0 +1,65 @@
+package disruptor_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sinuxlee/tile/pkg/disruptor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryKeepAcked(t *testing.T) {
+	broker := disruptor.NewMemoryBroker()
+
+	pr, err := disruptor.NewMemoryProducer(&disruptor.ProducerOptions{QueueName: "kept", ShardsCount: 1}, broker)
+	require.NoError(t, err)
+	defer pr.Close()
+	require.NoError(t, pr.Push(pr.Value(&order{Seq: 1})))
+
+	cn, err := disruptor.NewMemoryConsumer(&disruptor.ConsumerOptions{QueueName: "kept", Consumer: "c1", ShardsCount: 1, KeepAcked: true}, broker)
+	require.NoError(t, err)
+	defer cn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err, _ = cn.PopContext(ctx, cn.Value(&order{}), func(m disruptor.Message) error { return nil })
+	require.NoError(t, err)
+
+	// ack 后消息仍然保留
+	assert.Equal(t, 1, broker.Len("kept", 0))
+}
+
+func TestMemoryUnsupported(t *testing.T) {
+	broker := disruptor.NewMemoryBroker()
+
+	_, err := disruptor.NewMemoryProducer(&disruptor.ProducerOptions{QueueName: "unsupported", Priorities: 2}, broker)
+	assert.Equal(t, disruptor.ErrNotSupported, err)
+
+	_, err = disruptor.NewMemoryConsumer(&disruptor.ConsumerOptions{QueueName: "unsupported", Priorities: 2}, broker)
+	assert.Equal(t, disruptor.ErrNotSupported, err)
+
+	// 内存实现不处理的选项都返回 ErrNotSupported，不会静默忽略
+	for _, opt := range []*disruptor.ConsumerOptions{
+		{QueueName: "unsupported", DedupWindow: time.Minute},
+		{QueueName: "unsupported", ClaimMinIdle: time.Minute},
+		{QueueName: "unsupported", MoveDelayed: true},
+		{QueueName: "unsupported", AdaptivePrefetch: true},
+		{QueueName: "unsupported", HighWaterMark: 100},
+	} {
+		_, err = disruptor.NewMemoryConsumer(opt, broker)
+		assert.Equal(t, disruptor.ErrNotSupported, err)
+	}
+
+	for _, opt := range []*disruptor.ProducerOptions{
+		{QueueName: "unsupported", MaxLen: 100},
+		{QueueName: "unsupported", MaxAge: time.Minute},
+		{QueueName: "unsupported", SendRetries: 3},
+		{QueueName: "unsupported", SpillDir: t.TempDir()},
+		{QueueName: "unsupported", MoveDelayed: true},
+	} {
+		_, err = disruptor.NewMemoryProducer(opt, broker)
+		assert.Equal(t, disruptor.ErrNotSupported, err)
+	}
+}
@@ -0,0 +1,43 @@
+package disruptor
+
+import "time"
+
+// 本地缓冲的名称，用于 Metrics.BufferDepth
+const (
+	BufferProducer = "producer" // 生产者等待发送的消息
+	BufferConsumer = "consumer" // 消费者等待处理的消息
+	BufferAck      = "ack"      // 消费者等待 ack 的消息
+)
+
+// Metrics 接收生产者和消费者的运行指标，实现需要是并发安全的。
+// lane 为消息的优先级，每个优先级使用一组分片，没有优先级时为0
+type Metrics interface {
+	// Pushed 消息进入生产者的本地缓冲
+	Pushed(queue string)
+	// Sent 一批消息写入分片，latency 为这次 pipeline 的耗时
+	Sent(queue string, lane int, shard int, count int, latency time.Duration)
+	// SendFailed 一批消息重试后最终写入失败
+	SendFailed(queue string, lane int, shard int, count int)
+	// Received 消费者从分片读取到消息
+	Received(queue string, lane int, shard int, count int)
+	// Acked 一批消息 ack 成功，latency 为这次 pipeline 的耗时
+	Acked(queue string, lane int, shard int, count int, latency time.Duration)
+	// AckFailed 一批消息重试后最终 ack 失败
+	AckFailed(queue string, lane int, shard int, count int)
+	// HandleFailed 消息重试后最终处理失败
+	HandleFailed(queue string, lane int, shard int)
+	// BufferDepth 本地缓冲中的消息数量，定期上报
+	BufferDepth(queue string, buffer string, depth int)
+}
+
+// nopMetrics 默认不收集指标
+type nopMetrics struct{}
+
+func (nopMetrics) Pushed(string)                              {}
+func (nopMetrics) Sent(string, int, int, int, time.Duration)  {}
+func (nopMetrics) SendFailed(string, int, int, int)           {}
+func (nopMetrics) Received(string, int, int, int)             {}
+func (nopMetrics) Acked(string, int, int, int, time.Duration) {}
+func (nopMetrics) AckFailed(string, int, int, int)            {}
+func (nopMetrics) HandleFailed(string, int, int)              {}
+func (nopMetrics) BufferDepth(string, string, int)            {}
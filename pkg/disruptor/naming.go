@@ -0,0 +1,157 @@
+package disruptor
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// clusterSlots Redis Cluster 的 slot 数量
+const clusterSlots = 16384
+
+// Naming 为队列的分片选择 Redis Cluster 的 hash tag。tag 相同的分片位于同一个 slot，消费者合并读取；
+// tag 为空时使用分片序号作为 hash tag，和旧版本创建的队列相同。
+// 选择的结果保存在队列描述中，只在创建队列和重新分片时调用，之后所有节点使用相同的 key
+type Naming interface {
+	// Tags 返回分片 from 到 to-1 的 hash tag
+	Tags(cli redis.UniversalClient, queue string, from, to int) ([]string, error)
+}
+
+// ShardNaming 使用分片序号作为 hash tag，所有队列的同一个分片位于同一个 slot
+type ShardNaming struct{}
+
+func (ShardNaming) Tags(cli redis.UniversalClient, queue string, from, to int) ([]string, error) {
+	return make([]string, to-from), nil
+}
+
+// SlotNaming 默认的命名方式。集群中把队列的分片按顺序轮流分配给各个 master，起始的 master 由队列名决定，
+// 分配给同一个 master 的分片使用相同的 tag；单节点时所有分片使用相同的 tag，消费者一次读取全部分片
+type SlotNaming struct{}
+
+func (SlotNaming) Tags(cli redis.UniversalClient, queue string, from, to int) ([]string, error) {
+	tags := make([]string, to-from)
+	switch c := cli.(type) {
+	case *redis.Client:
+		for i := range tags {
+			tags[i] = queue
+		}
+	case *redis.ClusterClient:
+		slots, err := c.ClusterSlots().Result()
+		if err != nil {
+			return nil, err
+		}
+
+		masters := masterSlots(slots)
+		if len(masters) == 0 {
+			return nil, fmt.Errorf("disruptor: no master in cluster slots")
+		}
+
+		offset := shardOf(queue, len(masters))
+		for i := range tags {
+			tags[i] = masterTag(queue, masters[(offset+from+i)%len(masters)])
+		}
+	default:
+		// 其他客户端按 key 分布的方式未知，每个分片单独使用一个 tag
+		for i := range tags {
+			tags[i] = fmt.Sprintf("%v.%v", queue, from+i)
+		}
+	}
+
+	return tags, nil
+}
+
+// masterSlots 每个 master 负责的 slot 范围，按第一个 slot 排序，保证各个节点计算的顺序相同
+func masterSlots(slots []redis.ClusterSlot) [][]redis.ClusterSlot {
+	index := make(map[string]int)
+	var masters [][]redis.ClusterSlot
+	for _, s := range slots {
+		if len(s.Nodes) == 0 {
+			continue
+		}
+
+		addr := s.Nodes[0].Addr
+		i, ok := index[addr]
+		if !ok {
+			i = len(masters)
+			index[addr] = i
+			masters = append(masters, nil)
+		}
+
+		masters[i] = append(masters[i], s)
+	}
+
+	for _, m := range masters {
+		sort.Slice(m, func(i, j int) bool { return m[i].Start < m[j].Start })
+	}
+
+	sort.Slice(masters, func(i, j int) bool { return masters[i][0].Start < masters[j][0].Start })
+	return masters
+}
+
+// masterTag 找到 slot 属于 ranges 的 tag，相同的队列和 master 得到相同的 tag
+func masterTag(queue string, ranges []redis.ClusterSlot) string {
+	for n := 0; n < 16*clusterSlots; n++ {
+		tag := queue + "." + strconv.Itoa(n)
+		slot := slotOf(tag)
+		for _, r := range ranges {
+			if slot >= r.Start && slot <= r.End {
+				return tag
+			}
+		}
+	}
+
+	return queue
+}
+
+// slotOf 计算 hash tag 所在的 slot，CRC16 XMODEM
+func slotOf(tag string) int {
+	var crc uint16
+	for i := 0; i < len(tag); i++ {
+		crc ^= uint16(tag[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return int(crc) % clusterSlots
+}
+
+// shardTags 队列各个分片的 hash tag，重新分片后增加
+type shardTags struct {
+	mu   sync.RWMutex
+	tags []string
+}
+
+func (t *shardTags) set(tags []string) {
+	t.mu.Lock()
+	t.tags = tags
+	t.mu.Unlock()
+}
+
+// get 没有记录的分片使用分片序号
+func (t *shardTags) get(shard int) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if shard < len(t.tags) {
+		return t.tags[shard]
+	}
+
+	return ""
+}
+
+// slot 分片的 hash tag 实际的值，值相同的分片位于同一个 slot
+func (t *shardTags) slot(shard int) string {
+	if tag := t.get(shard); tag != "" {
+		return tag
+	}
+
+	return strconv.Itoa(shard)
+}
@@ -0,0 +1,48 @@
+package disruptor
+
+import (
+	"testing"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlotOf(t *testing.T) {
+	assert.Equal(t, 12739, slotOf("123456789"))
+	assert.Equal(t, 12182, slotOf("foo"))
+}
+
+func TestMasterTag(t *testing.T) {
+	slots := []redis.ClusterSlot{
+		{Start: 10923, End: 16383, Nodes: []redis.ClusterNode{{Addr: "c"}}},
+		{Start: 0, End: 5460, Nodes: []redis.ClusterNode{{Addr: "a"}}},
+		{Start: 5461, End: 10922, Nodes: []redis.ClusterNode{{Addr: "b"}}},
+	}
+
+	masters := masterSlots(slots)
+	require.Len(t, masters, 3)
+
+	used := make(map[string]bool)
+	for _, ranges := range masters {
+		tag := masterTag("orders", ranges)
+		slot := slotOf(tag)
+		assert.Truef(t, slot >= ranges[0].Start && slot <= ranges[0].End, "tag %v slot %v out of range", tag, slot)
+		used[tag] = true
+	}
+
+	assert.Len(t, used, 3)
+}
+
+func TestSlotNaming(t *testing.T) {
+	cli := redis.NewClient(&redis.Options{})
+	defer cli.Close()
+
+	tags, err := SlotNaming{}.Tags(cli, "orders", 2, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"orders", "orders"}, tags)
+
+	d := &Descriptor{Tags: []string{"orders", "orders"}}
+	assert.Equal(t, "disruptor:orders:{orders}:1", d.streamName("orders", 1))
+	assert.Equal(t, "disruptor:orders:{2}", d.streamName("orders", 2))
+}
@@ -0,0 +1,90 @@
+package disruptor
+
+// WithPriority 设置消息的优先级，范围是 0 到 ProducerOptions.Priorities-1，数值越大越先被消费。
+// 相同 key 的消息只在同一个优先级内有序，内存实现不支持优先级
+func WithPriority(p int) PushOption {
+	return func(m *outMessage) {
+		m.lane = p
+	}
+}
+
+// laneWeights 各个优先级每轮最多处理的消息数，没有配置的优先级 p 使用 4^p，最小为1
+func laneWeights(lanes int, weights []int) []int {
+	res := make([]int, lanes)
+	for i := range res {
+		res[i] = 1 << (2 * uint(i))
+		if i < len(weights) {
+			res[i] = weights[i]
+		}
+
+		if res[i] < 1 {
+			res[i] = 1
+		}
+	}
+
+	return res
+}
+
+// dispatch 按优先级把各个缓冲中的消息交给 msgChan，总是先选择还有次数的最高优先级，
+// 有消息的优先级次数都用完后开始新的一轮，低优先级每轮至少处理一条，不会被饿死
+func (c *consumer) dispatch() {
+	weights := laneWeights(c.lanes, c.PriorityWeights)
+	credits := make([]int, c.lanes)
+	copy(credits, weights)
+
+	// 每个优先级取出的第一条消息，msgChan 只有在 Pop 时才能写入，高优先级的新消息可以替换等待中的选择
+	heads := make([]*Message, c.lanes)
+	defer func() {
+		for _, m := range heads {
+			if m != nil {
+				c.release(*m)
+			}
+		}
+
+		c.wgCons.Done()
+	}()
+
+	for {
+		lane := -1
+		for i := c.lanes - 1; i >= 0; i-- {
+			if heads[i] == nil {
+				select {
+				case m := <-c.laneChans[i]:
+					heads[i] = &m
+				default:
+				}
+			}
+		}
+
+		for round := 0; round < 2 && lane < 0; round++ {
+			for i := c.lanes - 1; i >= 0; i-- {
+				if heads[i] != nil && credits[i] > 0 {
+					lane = i
+					break
+				}
+			}
+
+			if lane < 0 {
+				copy(credits, weights)
+			}
+		}
+
+		if lane < 0 {
+			select {
+			case <-c.wake:
+				continue
+			case <-c.done:
+				return
+			}
+		}
+
+		select {
+		case c.msgChan <- *heads[lane]:
+			heads[lane] = nil
+			credits[lane]--
+		case <-c.wake:
+		case <-c.done:
+			return
+		}
+	}
+}
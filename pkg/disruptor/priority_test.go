@@ -0,0 +1,119 @@
+package disruptor_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sinuxlee/tile/pkg/disruptor"
+	"github.com/sinuxlee/tile/pkg/disruptor/disruptortest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPriority(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{
+		QueueName: "commands", ShardsCount: 1, Priorities: 2, PipePeriod: 5 * time.Millisecond,
+	}, cli)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, pr.Push(pr.Value(&order{Seq: i})))
+	}
+
+	for i := 10; i < 20; i++ {
+		require.NoError(t, pr.Push(pr.Value(&order{Seq: i}), disruptor.WithPriority(1)))
+	}
+	pr.Close()
+
+	cn, err := disruptor.NewConsumer(&disruptor.ConsumerOptions{
+		QueueName: "commands", Consumer: "c1", ShardsCount: 1, Priorities: 2, Block: 10 * time.Millisecond,
+	}, cli)
+	require.NoError(t, err)
+	defer cn.Close()
+
+	// 等待两个优先级的消息都读取到本地缓冲
+	require.Eventually(t, func() bool {
+		info, err := disruptor.Inspect(cli, "commands", "", 0)
+		return err == nil && info.Pending == 20
+	}, 2*time.Second, 10*time.Millisecond)
+
+	var seqs []int
+	for i := 0; i < 20; i++ {
+		err, _ := cn.PopContext(context.Background(), cn.Value(&order{}), func(m disruptor.Message) error {
+			seqs = append(seqs, m.Data.(*order).Seq)
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	// 默认权重下每轮处理4条高优先级的消息和1条低优先级的消息
+	assert.Equal(t, []int{10, 11, 12, 13, 0, 14, 15, 16, 17, 1, 18, 19, 2, 3, 4, 5, 6, 7, 8, 9}, seqs)
+}
+
+func TestPriorityLanes(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{
+		QueueName: "lanes", ShardsCount: 1, Priorities: 2, PipePeriod: 5 * time.Millisecond,
+	}, cli)
+	require.NoError(t, err)
+	defer pr.Close()
+
+	_, err = pr.PushSync(context.Background(), pr.Value(&order{Seq: 0}))
+	require.NoError(t, err)
+	_, err = pr.PushSync(context.Background(), pr.Value(&order{Seq: 1}), disruptor.WithPriority(1))
+	require.NoError(t, err)
+
+	desc, err := disruptor.ReadDescriptor(cli, "lanes")
+	require.NoError(t, err)
+	assert.Equal(t, 2, desc.Lanes)
+
+	// 扩容时每个优先级都增加分片
+	require.NoError(t, disruptor.Reshard(cli, "lanes", 2))
+	info, err := disruptor.Inspect(cli, "lanes", "", 0)
+	require.NoError(t, err)
+	require.Len(t, info.Shards, 4)
+	assert.EqualValues(t, 2, info.Length)
+	for i, shard := range info.Shards {
+		assert.Equal(t, i/2, shard.Priority)
+	}
+
+	// 重新处理时先处理高优先级的消息
+	var seqs []int
+	n, err := disruptor.Replay(context.Background(), cli, &disruptor.ReplayOptions{QueueName: "lanes"},
+		func() disruptor.Marshaler { return pr.Value(&order{}) }, func(m disruptor.Message) error {
+			seqs = append(seqs, m.Data.(*order).Seq)
+			return nil
+		})
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []int{1, 0}, seqs)
+}
+
+func TestPriorityFromDescriptor(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{
+		QueueName: "alerts", ShardsCount: 1, Priorities: 2, PipePeriod: 5 * time.Millisecond,
+	}, cli)
+	require.NoError(t, err)
+	defer pr.Close()
+
+	_, err = pr.PushSync(context.Background(), pr.Value(&order{Seq: 1}), disruptor.WithPriority(1))
+	require.NoError(t, err)
+
+	// 没有配置优先级的消费者按队列描述读取所有优先级
+	cn, err := disruptor.NewConsumer(&disruptor.ConsumerOptions{
+		QueueName: "alerts", Consumer: "c1", ShardsCount: 1, Block: 10 * time.Millisecond, PipePeriod: 5 * time.Millisecond,
+	}, cli)
+	require.NoError(t, err)
+	defer cn.Close()
+
+	require.NoError(t, popTimeout(cn, func(m disruptor.Message) error {
+		assert.Equal(t, 1, m.Data.(*order).Seq)
+		return nil
+	}))
+}
@@ -1,7 +1,11 @@
 package disruptor
 
 import (
+	"context"
+	"hash/fnv"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v7"
@@ -14,23 +18,76 @@ var defaultProducerOptions = ProducerOptions{
 	PendingBufferSize: 50000,                  // 本地消息缓存队列
 	PipeBufferSize:    100,                    // 每个分片队列 pipeline 个数
 	PipePeriod:        100 * time.Millisecond, // 分片队列每次发送前等待的最长时间
+	TrimPeriod:        time.Minute,            // 裁剪分片队列的时间间隔
+	PendingMaxAge:     time.Hour,              // 没有 ack 的消息超过 MaxAge 后最多再保留的时长
+	Codec:             JSON,                   // Value 的编码方式
+	DelayPeriod:       time.Second,            // 检查到期延迟消息的时间间隔
+	WatchPeriod:       10 * time.Second,       // 检查分片数量变化的时间间隔
+	SpillPeriod:       time.Second,            // 重新发送本地文件中消息的时间间隔
+	Priorities:        1,                      // 默认没有优先级
+	Naming:            SlotNaming{},           // 分片的 hash tag 按集群的 master 分配
+	Metrics:           nopMetrics{},
 }
 
 type ProducerOptions struct {
 	QueueName         string
-	ShardsCount       int8
+	ShardsCount       int8          // 第一次创建队列时的分片数量，之后以 Redis 中的队列描述为准
 	PendingBufferSize int64         // 本地消息缓冲的大小
 	PipeBufferSize    int64         // 每次批量发送的数量
 	PipePeriod        time.Duration // 批量发送数据的时间间隔
+	SendRetries       int           // 批量发送失败后的重试次数，为0时一直重试，设置了 SpillDir 时不重试直接写入本地文件
+	MaxLen            int64         // 每个分片保留的大约消息数，为0时不限制
+	MaxAge            time.Duration // 分片中消息保留的最长时间，为0时不限制。消费组还没有读取的消息超过后照常裁剪
+	PendingMaxAge     time.Duration // 消费组已经读取还没有 ack 的消息超过 MaxAge 后最多再保留的时长，消费者需要在这段时间内回收或者 ack
+	TrimPeriod        time.Duration // 定期裁剪分片队列的时间间隔
+	NodeID            string        // 生产者的节点id，写入每条消息的消息头
+	Codec             Codec         // Value 的编码方式
+	DelayPeriod       time.Duration // 检查到期延迟消息的时间间隔
+	MoveDelayed       bool          // 是否转移到期的延迟消息，没有设置时在第一次 PushAt 后开始转移
+	WatchPeriod       time.Duration // 检查分片数量变化的时间间隔
+	Driver            Driver        // 队列的存储后端，为空时使用 Redis Streams
+	SpillDir          string        // Redis 不可用时消息写入该目录的段文件，恢复后按顺序重新发送，为空时不写入。同一个队列只能有一个生产者使用同一个目录
+	SpillPeriod       time.Duration // 尝试重新发送本地文件中消息的时间间隔
+	Priorities        int           // 优先级的数量，每个优先级使用一组分片，队列描述中记录了更多的优先级时以队列描述为准
+	Naming            Naming        // 第一次创建队列时选择分片的 hash tag，之后以 Redis 中的队列描述为准
 	ErrorNotifier     ErrorNotifier
+	Metrics           Metrics
+}
+
+// outMessage 等待发送的消息
+type outMessage struct {
+	body    []byte
+	headers Headers
+	key     string      // 分片的依据，相同 key 的消息发往同一个分片
+	keyed   bool        // 是否指定了 key
+	lane    int         // 消息的优先级
+	done    ConfirmFunc // 发送结果回调，为 nil 时不需要确认
+}
+
+// confirmResult 确认发送的结果
+type confirmResult struct {
+	id  string
+	err error
 }
 
 type producer struct {
 	*client
 	*ProducerOptions
-	msgChan chan []byte // 本地的消息缓冲
+	msgChan chan *outMessage // 本地的消息缓冲
+	done    chan struct{}
 	emitter ErrorNotifier
 	wg      *sync.WaitGroup
+
+	moverOnce sync.Once // 延迟消息的转移协程只启动一次
+
+	mu        sync.RWMutex  // 保护 msgChan 的关闭，Push 持有读锁
+	closing   chan struct{} // 关闭后 Push 返回 ErrClosed
+	closeOnce sync.Once
+	abort     context.Context // 关闭超时后取消，发送协程停止重试
+	cancel    context.CancelFunc
+	dropped   int64 // 关闭过程中丢弃的消息数
+
+	spill *spiller // 没有设置 SpillDir 时为 nil
 }
 
 func NewProducer(opt *ProducerOptions, rdsCli redis.UniversalClient) (Producer, error) {
@@ -38,48 +95,268 @@ func NewProducer(opt *ProducerOptions, rdsCli redis.UniversalClient) (Producer,
 		return nil, err
 	}
 
-	cli, err := newClient(opt.QueueName, opt.ShardsCount, rdsCli)
+	driver, rdsCli := selectDriver(opt.Driver, &redisDriver{cli: rdsCli, maxLen: opt.MaxLen})
+	if rdsCli == nil && (opt.MaxLen > 0 || opt.MaxAge > 0 || opt.MoveDelayed) {
+		return nil, ErrNotSupported
+	}
+
+	cli, err := newClient(opt.QueueName, opt.ShardsCount, opt.Codec.Name(), opt.Priorities, opt.Naming, rdsCli, driver)
 	if err != nil {
 		return nil, err
 	}
 
-	cache := make(chan []byte, opt.PendingBufferSize)
+	cache := make(chan *outMessage, opt.PendingBufferSize)
+	abort, cancel := context.WithCancel(context.Background())
 	pr := &producer{
 		msgChan:         cache,
 		client:          cli,
 		emitter:         opt.ErrorNotifier,
 		ProducerOptions: opt,
 		wg:              &sync.WaitGroup{},
+		done:            make(chan struct{}),
+		closing:         make(chan struct{}),
+		abort:           abort,
+		cancel:          cancel,
+	}
+
+	if opt.SpillDir != "" {
+		pr.spill, err = newSpiller(opt.SpillDir, opt.QueueName)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+
+		// 上次运行时写入的段文件也在这里重新发送
+		pr.wg.Add(1)
+		go pr.replaySpilled()
 	}
 
 	pr.wg.Add(1)
 	go pr.produce()
 
+	if opt.MaxLen > 0 || opt.MaxAge > 0 {
+		pr.wg.Add(1)
+		go pr.trim()
+	}
+
+	if pr.redisClient != nil {
+		pr.wg.Add(1)
+		go func() {
+			pr.watchShards(opt.WatchPeriod, pr.done, pr.emitter, pr.grow)
+			pr.wg.Done()
+		}()
+	}
+
+	if opt.MoveDelayed {
+		pr.startMover()
+	}
+
 	return pr, nil
 }
 
+// grow 重新分片后在新的分片上创建各个优先级的默认消费组
+func (p *producer) grow(from, to int) {
+	if err := p.prepareLanes(to); err != nil && p.emitter != nil {
+		p.emitter.EmitError(err)
+	}
+}
+
 func (p *producer) Close() {
-	close(p.msgChan)
-	p.wg.Wait()
+	_, _ = p.CloseContext(context.Background())
+}
+
+func (p *producer) CloseContext(ctx context.Context) (int, error) {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+
+		// 等待正在进行的 Push 返回后再关闭缓冲
+		p.mu.Lock()
+		close(p.done)
+		close(p.msgChan)
+		p.mu.Unlock()
+	})
+
+	stopped := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(stopped)
+	}()
+
+	var err error
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		// 停止重试，剩下的消息写入 SpillDir 或者丢弃
+		err = ctx.Err()
+		p.cancel()
+		<-stopped
+	}
+
+	if p.spill != nil {
+		p.spill.close()
+	}
+
+	p.cancel()
+	return int(atomic.LoadInt64(&p.dropped)), err
+}
+
+// enqueue 把消息放入本地缓冲，block 为 false 时缓冲已满立即返回 ErrBufferFull
+func (p *producer) enqueue(ctx context.Context, m *outMessage, block bool) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	select {
+	case <-p.closing:
+		return ErrClosed
+	default:
+	}
+
+	if !block {
+		select {
+		case p.msgChan <- m:
+			p.Metrics.Pushed(p.QueueName)
+			return nil
+		default:
+			return ErrBufferFull
+		}
+	}
+
+	select {
+	case p.msgChan <- m:
+		p.Metrics.Pushed(p.QueueName)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.closing:
+		return ErrClosed
+	}
+}
+
+func (p *producer) Push(data Marshaler, opts ...PushOption) error {
+	return p.PushContext(context.Background(), data, opts...)
+}
+
+func (p *producer) PushContext(ctx context.Context, data Marshaler, opts ...PushOption) error {
+	return p.push(ctx, data, nil, opts)
+}
+
+func (p *producer) TryPush(data Marshaler, opts ...PushOption) error {
+	m, err := p.newOutMessage(data, nil, opts)
+	if err != nil {
+		return err
+	}
+
+	return p.enqueue(context.Background(), m, false)
+}
+
+func (p *producer) PushConfirm(data Marshaler, cb ConfirmFunc, opts ...PushOption) error {
+	return p.push(context.Background(), data, cb, opts)
+}
+
+func (p *producer) PushSync(ctx context.Context, data Marshaler, opts ...PushOption) (string, error) {
+	res := make(chan confirmResult, 1)
+	err := p.push(ctx, data, func(id string, err error) {
+		res <- confirmResult{id: id, err: err}
+	}, opts)
+
+	if err != nil {
+		return "", err
+	}
+
+	select {
+	case r := <-res:
+		return r.id, r.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (p *producer) newOutMessage(data Marshaler, cb ConfirmFunc, opts []PushOption) (*outMessage, error) {
+	m, err := makeOutMessage(p.NodeID, data, cb, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// 超出范围的优先级使用最接近的优先级
+	if m.lane >= p.lanes {
+		m.lane = p.lanes - 1
+	} else if m.lane < 0 {
+		m.lane = 0
+	}
+
+	return m, nil
 }
 
-func (p *producer) Push(data Marshaler) error {
+// makeOutMessage 编码消息体并设置默认的消息头，opts 最后执行，可以覆盖默认值
+func makeOutMessage(nodeID string, data Marshaler, cb ConfirmFunc, opts []PushOption) (*outMessage, error) {
 	d, err := data.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &outMessage{body: d, done: cb}
+	if v, ok := data.(*codecValue); ok {
+		WithHeader(HeaderContentType, v.codec.Name())(m)
+		if k, ok := v.v.(Keyed); ok {
+			WithKey(k.Key())(m)
+		}
+	} else if k, ok := data.(Keyed); ok {
+		WithKey(k.Key())(m)
+	}
+
+	id, err := newMessageID()
+	if err != nil {
+		return nil, err
+	}
+
+	WithHeader(HeaderMessageID, id)(m)
+	WithHeader(HeaderPublishedAt, strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10))(m)
+	if nodeID != "" {
+		WithHeader(HeaderProducer, nodeID)(m)
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m, nil
+}
+
+func (p *producer) Value(v interface{}) Marshaler {
+	return &codecValue{codec: p.Codec, v: v}
+}
+
+func (p *producer) push(ctx context.Context, data Marshaler, cb ConfirmFunc, opts []PushOption) error {
+	m, err := p.newOutMessage(data, cb, opts)
 	if err != nil {
 		return err
 	}
 
-	p.msgChan <- d
-	return nil
+	return p.enqueue(ctx, m, true)
 }
 
 func (p *producer) produce() {
-	shard := 0
-	idx := 0
+	shards := 0
+	rr := 0 // 没有 key 的消息轮流发往各个分片
 	isRunning := true
-	doSend := false
 
-	buf := make([][]byte, p.PipeBufferSize)
+	// 同一个分片的批次由同一个协程按顺序发送，保证相同 key 的消息有序，下标为优先级和分片
+	senders := make([][]chan *sendBatch, p.lanes)
+	bufs := make([][][]*outMessage, p.lanes)
+	grow := func() {
+		for ; shards < p.shards(); shards++ {
+			for lane := range senders {
+				ch := make(chan *sendBatch, 16)
+				senders[lane] = append(senders[lane], ch)
+				bufs[lane] = append(bufs[lane], nil)
+
+				p.wg.Add(1)
+				go p.send(ch)
+			}
+		}
+	}
+
+	grow()
 	tick := time.NewTicker(p.PipePeriod)
 	started := time.Now()
 	for isRunning {
@@ -87,87 +364,183 @@ func (p *producer) produce() {
 		case msg, more := <-p.msgChan:
 			if !more {
 				isRunning = false
-			} else {
-				buf[idx] = msg
-				idx++
+				break
+			}
+
+			shard := rr
+			if msg.keyed {
+				shard = shardOf(msg.key, shards)
+			}
+
+			lane := msg.lane
+			bufs[lane][shard] = append(bufs[lane][shard], msg)
+			if len(bufs[lane][shard]) >= int(p.PipeBufferSize) {
+				senders[lane][shard] <- p.makeBatch(lane, shard, bufs[lane][shard])
+				bufs[lane][shard] = nil
+				if shard == rr {
+					rr = (rr + 1) % shards
+				}
 			}
 		case <-tick.C:
+			p.Metrics.BufferDepth(p.QueueName, BufferProducer, len(p.msgChan))
 		}
 
-		if isRunning {
-			switch {
-			case idx == int(p.PipeBufferSize):
-				doSend = true
-			case time.Since(started) >= p.PipePeriod && len(p.msgChan) == 0:
-				doSend = true
-			default:
-				doSend = false
-			}
+		if isRunning && (time.Since(started) < p.PipePeriod || len(p.msgChan) != 0) {
+			continue
+		}
 
-			if !doSend {
-				continue
+		for lane := range bufs {
+			for shard, buf := range bufs[lane] {
+				if len(buf) != 0 {
+					senders[lane][shard] <- p.makeBatch(lane, shard, buf)
+					bufs[lane][shard] = nil
+				}
 			}
 		}
 
-		p.sendWithLock(shard, buf[0:idx])
+		// 重新分片后开始使用新的分片
+		grow()
 
-		idx = 0
-		shard++
-		shard %= int(p.ShardsCount)
+		rr = (rr + 1) % shards
 		started = time.Now()
 	}
 
+	tick.Stop()
+	for _, lane := range senders {
+		for _, ch := range lane {
+			close(ch)
+		}
+	}
+
 	p.wg.Done()
 }
 
-func (p *producer) sendWithLock(shard int, buf [][]byte) {
-	if len(buf) == 0 {
-		return
-	}
+// shardOf 计算 key 所在的分片
+func shardOf(key string, shards int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(shards))
+}
 
-	args := make([]redis.XAddArgs, len(buf))
-	stream := makeStreamName(p.QueueName, shard)
+// sendBatch 发往同一个优先级的同一个分片的一批消息
+type sendBatch struct {
+	lane    int
+	shard   int
+	records []Record
+	msgs    []*outMessage
+}
 
+func (p *producer) makeBatch(lane int, shard int, buf []*outMessage) *sendBatch {
+	records := make([]Record, len(buf))
 	for i, m := range buf {
-		args[i] = redis.XAddArgs{
-			ID:     "*",
-			Stream: stream,
-			Values: map[string]interface{}{dataField: m},
-		}
+		records[i] = Record{Body: m.body, Headers: m.headers}
+	}
+
+	return &sendBatch{lane: lane, shard: shard, records: records, msgs: buf}
+}
+
+func (p *producer) send(ch chan *sendBatch) {
+	for b := range ch {
+		p.pipelineTransfer(b)
+	}
+
+	p.wg.Done()
+}
+
+// append 写入批次，关闭超时后不再等待 Append 返回，批次按发送失败处理。
+// 这时 Append 可能之后才写入成功，计入丢失或者写入段文件的消息可能重复
+func (p *producer) append(b *sendBatch) ([]string, error) {
+	type result struct {
+		ids []string
+		err error
 	}
 
-	p.wg.Add(1)
+	res := make(chan result, 1)
 	go func() {
-		p.pipelineTransfer(args)
-		p.wg.Done()
+		ids, err := p.driver.Append(p.laneQueue(b.lane), b.shard, b.records)
+		res <- result{ids: ids, err: err}
 	}()
+
+	select {
+	case r := <-res:
+		return r.ids, r.err
+	case <-p.abort.Done():
+		return nil, p.abort.Err()
+	}
 }
 
-func (p *producer) pipelineTransfer(args []redis.XAddArgs) {
-	err := repeat.Repeat(
-		repeat.Fn(func() error {
-			pipe := p.redisClient.TxPipeline()
+func (p *producer) pipelineTransfer(b *sendBatch) {
+	// 本地文件中还有没重新发送的消息时，新的批次也写入文件，保证顺序
+	if p.spill != nil {
+		if ok, err := p.spill.write(b, false); ok {
+			p.spilled(b, err)
+			return
+		}
+	}
 
-			for _, m := range args {
-				pipe.XAdd(&m)
+	var ids []string
+	opts := []repeat.Operation{
+		repeat.Fn(func() error {
+			// 关闭超时后不再发送
+			if err := p.abort.Err(); err != nil {
+				return repeat.HintStop(err)
 			}
 
-			_, err := pipe.Exec()
+			started := time.Now()
+			var err error
+			ids, err = p.append(b)
 			if err != nil {
 				if p.emitter != nil {
 					p.emitter.EmitError(err)
 				}
 
+				if err == p.abort.Err() {
+					return repeat.HintStop(err)
+				}
+
 				return repeat.HintTemporary(err)
 			}
 
+			p.Metrics.Sent(p.QueueName, b.lane, b.shard, len(b.records), time.Since(started))
 			return nil
 		}),
 		repeat.StopOnSuccess(),
-		repeat.WithDelay(repeat.FullJitterBackoff(500*time.Millisecond).Set()),
-	)
+	}
 
-	if err != nil && p.emitter != nil {
-		p.emitter.EmitError(err)
+	if p.SendRetries > 0 || p.spill != nil {
+		opts = append(opts, repeat.LimitMaxTries(p.SendRetries))
+	}
+
+	opts = append(opts, repeat.WithDelay(
+		repeat.FullJitterBackoff(500*time.Millisecond).Set(),
+		repeat.SetContext(p.abort),
+	))
+	err := repeat.Repeat(opts...)
+
+	if err != nil {
+		p.Metrics.SendFailed(p.QueueName, b.lane, b.shard, len(b.records))
+		if p.emitter != nil {
+			p.emitter.EmitError(err)
+		}
+
+		if p.spill != nil {
+			_, err := p.spill.write(b, true)
+			p.spilled(b, err)
+			return
+		}
+
+		p.lost(b)
+	}
+
+	for i, m := range b.msgs {
+		if m.done == nil {
+			continue
+		}
+
+		if err != nil {
+			m.done("", err)
+		} else {
+			m.done(ids[i], nil)
+		}
 	}
 }
@@ -0,0 +1,23 @@
+package disruptor
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardOf(t *testing.T) {
+	shards := 10
+	used := make(map[int]bool)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("player_%v", i)
+		shard := shardOf(key, shards)
+
+		assert.Truef(t, shard >= 0 && shard < shards, "shard %v out of range", shard)
+		assert.Equalf(t, shard, shardOf(key, shards), "same key must map to the same shard")
+		used[shard] = true
+	}
+
+	assert.Equalf(t, shards, len(used), "keys should spread over all shards")
+}
@@ -0,0 +1,163 @@
+package promx
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sinuxlee/tile/pkg/disruptor"
+)
+
+var _ disruptor.Metrics = (*Metrics)(nil)
+
+// Metrics 把 disruptor 的运行指标导出给 Prometheus，同时实现了 disruptor.Metrics 和 prometheus.Collector
+type Metrics struct {
+	pushed       *prometheus.CounterVec
+	sent         *prometheus.CounterVec
+	sendFailed   *prometheus.CounterVec
+	received     *prometheus.CounterVec
+	acked        *prometheus.CounterVec
+	ackFailed    *prometheus.CounterVec
+	handleFailed *prometheus.CounterVec
+	buffer       *prometheus.GaugeVec
+	sendLatency  *prometheus.HistogramVec
+	ackLatency   *prometheus.HistogramVec
+	batchSize    *prometheus.HistogramVec
+}
+
+// New 创建指标，需要通过 prometheus.MustRegister 注册后才能导出
+func New(namespace string) *Metrics {
+	shardLabels := []string{"queue", "priority", "shard"}
+	latencyBuckets := prometheus.ExponentialBuckets(0.0005, 2, 14)
+
+	return &Metrics{
+		pushed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "disruptor",
+			Name:      "pushed_total",
+			Help:      "Messages accepted into the producer buffer.",
+		}, []string{"queue"}),
+		sent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "disruptor",
+			Name:      "sent_total",
+			Help:      "Messages written to a shard stream.",
+		}, shardLabels),
+		sendFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "disruptor",
+			Name:      "send_failed_total",
+			Help:      "Messages that could not be written after retries.",
+		}, shardLabels),
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "disruptor",
+			Name:      "received_total",
+			Help:      "Messages read from a shard stream.",
+		}, shardLabels),
+		acked: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "disruptor",
+			Name:      "acked_total",
+			Help:      "Messages acknowledged on a shard stream.",
+		}, shardLabels),
+		ackFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "disruptor",
+			Name:      "ack_failed_total",
+			Help:      "Messages that could not be acknowledged after retries.",
+		}, shardLabels),
+		handleFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "disruptor",
+			Name:      "handle_failed_total",
+			Help:      "Messages whose handler failed after retries.",
+		}, shardLabels),
+		buffer: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "disruptor",
+			Name:      "buffer_depth",
+			Help:      "Messages waiting in a local buffer.",
+		}, []string{"queue", "buffer"}),
+		sendLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "disruptor",
+			Name:      "send_duration_seconds",
+			Help:      "Latency of the XADD pipeline.",
+			Buckets:   latencyBuckets,
+		}, shardLabels),
+		ackLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "disruptor",
+			Name:      "ack_duration_seconds",
+			Help:      "Latency of the XACK pipeline.",
+			Buckets:   latencyBuckets,
+		}, shardLabels),
+		batchSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "disruptor",
+			Name:      "batch_size",
+			Help:      "Messages per pipeline.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+		}, []string{"queue", "priority", "shard", "op"}),
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.pushed, m.sent, m.sendFailed, m.received, m.acked, m.ackFailed,
+		m.handleFailed, m.buffer, m.sendLatency, m.ackLatency, m.batchSize,
+	}
+}
+
+// Describe 实现 prometheus.Collector
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect 实现 prometheus.Collector
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+func (m *Metrics) Pushed(queue string) {
+	m.pushed.WithLabelValues(queue).Inc()
+}
+
+func (m *Metrics) Sent(queue string, lane int, shard int, count int, latency time.Duration) {
+	l, s := strconv.Itoa(lane), strconv.Itoa(shard)
+	m.sent.WithLabelValues(queue, l, s).Add(float64(count))
+	m.sendLatency.WithLabelValues(queue, l, s).Observe(latency.Seconds())
+	m.batchSize.WithLabelValues(queue, l, s, "send").Observe(float64(count))
+}
+
+func (m *Metrics) SendFailed(queue string, lane int, shard int, count int) {
+	m.sendFailed.WithLabelValues(queue, strconv.Itoa(lane), strconv.Itoa(shard)).Add(float64(count))
+}
+
+func (m *Metrics) Received(queue string, lane int, shard int, count int) {
+	m.received.WithLabelValues(queue, strconv.Itoa(lane), strconv.Itoa(shard)).Add(float64(count))
+}
+
+func (m *Metrics) Acked(queue string, lane int, shard int, count int, latency time.Duration) {
+	l, s := strconv.Itoa(lane), strconv.Itoa(shard)
+	m.acked.WithLabelValues(queue, l, s).Add(float64(count))
+	m.ackLatency.WithLabelValues(queue, l, s).Observe(latency.Seconds())
+	m.batchSize.WithLabelValues(queue, l, s, "ack").Observe(float64(count))
+}
+
+func (m *Metrics) AckFailed(queue string, lane int, shard int, count int) {
+	m.ackFailed.WithLabelValues(queue, strconv.Itoa(lane), strconv.Itoa(shard)).Add(float64(count))
+}
+
+func (m *Metrics) HandleFailed(queue string, lane int, shard int) {
+	m.handleFailed.WithLabelValues(queue, strconv.Itoa(lane), strconv.Itoa(shard)).Inc()
+}
+
+func (m *Metrics) BufferDepth(queue string, buffer string, depth int) {
+	m.buffer.WithLabelValues(queue, buffer).Set(float64(depth))
+}
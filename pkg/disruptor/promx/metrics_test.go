@@ -0,0 +1,100 @@
+package promx_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sinuxlee/tile/pkg/disruptor"
+	"github.com/sinuxlee/tile/pkg/disruptor/disruptortest"
+	"github.com/sinuxlee/tile/pkg/disruptor/promx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type score struct {
+	Value int `json:"value"`
+}
+
+// metric 查找名字和标签都相同的指标，没有时返回 nil
+func metric(t *testing.T, reg *prometheus.Registry, name string, labels map[string]string) *dto.Metric {
+	families, err := reg.Gather()
+	require.NoError(t, err)
+
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+
+		for _, m := range f.GetMetric() {
+			matched := 0
+			for _, l := range m.GetLabel() {
+				if v, ok := labels[l.GetName()]; ok && v == l.GetValue() {
+					matched++
+				}
+			}
+
+			if matched == len(labels) {
+				return m
+			}
+		}
+	}
+
+	return nil
+}
+
+func TestMetrics(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+
+	m := promx.New("test")
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(m))
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{
+		QueueName: "scores", ShardsCount: 1, Priorities: 2, PipePeriod: 5 * time.Millisecond, Metrics: m,
+	}, cli)
+	require.NoError(t, err)
+	defer pr.Close()
+	cn, err := disruptor.NewConsumer(&disruptor.ConsumerOptions{
+		QueueName: "scores", Consumer: "c1", ShardsCount: 1, Block: 10 * time.Millisecond, PipePeriod: 5 * time.Millisecond, Metrics: m,
+	}, cli)
+	require.NoError(t, err)
+	defer cn.Close()
+
+	_, err = pr.PushSync(context.Background(), pr.Value(&score{Value: 1}))
+	require.NoError(t, err)
+	_, err = pr.PushSync(context.Background(), pr.Value(&score{Value: 2}), disruptor.WithPriority(1))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		err, _ = cn.PopContext(ctx, cn.Value(&score{}), func(m disruptor.Message) error { return nil })
+		require.NoError(t, err)
+	}
+
+	// ack 在后台批量发送
+	shard := map[string]string{"queue": "scores", "priority": "0", "shard": "0"}
+	assert.Eventually(t, func() bool {
+		acked := metric(t, reg, "test_disruptor_acked_total", shard)
+		return acked != nil && acked.GetCounter().GetValue() == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// 各个优先级分别统计
+	assert.Equal(t, 2.0, metric(t, reg, "test_disruptor_pushed_total", map[string]string{"queue": "scores"}).GetCounter().GetValue())
+	high := map[string]string{"queue": "scores", "priority": "1", "shard": "0"}
+	assert.Equal(t, 1.0, metric(t, reg, "test_disruptor_sent_total", high).GetCounter().GetValue())
+	assert.Equal(t, 1.0, metric(t, reg, "test_disruptor_received_total", high).GetCounter().GetValue())
+	assert.Equal(t, 1.0, metric(t, reg, "test_disruptor_sent_total", shard).GetCounter().GetValue())
+	assert.Equal(t, 1.0, metric(t, reg, "test_disruptor_received_total", shard).GetCounter().GetValue())
+	assert.EqualValues(t, 1, metric(t, reg, "test_disruptor_send_duration_seconds", shard).GetHistogram().GetSampleCount())
+	assert.EqualValues(t, 1, metric(t, reg, "test_disruptor_ack_duration_seconds", shard).GetHistogram().GetSampleCount())
+
+	send := metric(t, reg, "test_disruptor_batch_size", map[string]string{"queue": "scores", "priority": "0", "shard": "0", "op": "send"}).GetHistogram()
+	assert.EqualValues(t, 1, send.GetSampleCount())
+	assert.Equal(t, 1.0, send.GetSampleSum())
+	assert.Equal(t, 0, testutil.CollectAndCount(m, "test_disruptor_handle_failed_total"))
+}
@@ -0,0 +1,96 @@
+package disruptor
+
+import (
+	"time"
+)
+
+// ClaimNotifier 接收从其他消费者回收消息的统计
+type ClaimNotifier interface {
+	EmitClaim(stream string, from string, count int)
+}
+
+// reclaim 定期把长时间未 ack 的消息转移给自己，避免消费者下线后消息永远滞留在 PEL 中。
+// 自己的消息只回收本地已经不再持有的，例如去重时跳过的正在处理的消息
+func (c *consumer) reclaim() {
+	tick := time.NewTicker(c.ClaimPeriod)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			c.wgCons.Done()
+			return
+		case <-tick.C:
+		}
+
+		for lane := 0; lane < c.lanes; lane++ {
+			for i := 0; i < c.shards(); i++ {
+				err := c.claimShard(lane, i)
+				if err != nil && c.emitter != nil {
+					c.emitter.EmitError(err)
+				}
+			}
+		}
+	}
+}
+
+func (c *consumer) claimShard(lane int, shard int) error {
+	stream := c.streamOf(lane, shard)
+	group := c.groupOf(lane)
+	records, err := c.driver.Claim(&ClaimArgs{
+		Queue:    c.laneQueue(lane),
+		Shard:    shard,
+		Group:    group,
+		Consumer: c.Consumer,
+		Count:    c.PrefetchCount,
+		MinIdle:  c.ClaimMinIdle,
+		Held: func(id string) bool {
+			_, ok := c.held.Load(heldKey(stream, id))
+			return ok
+		},
+	})
+
+	if err != nil || len(records) == 0 {
+		return err
+	}
+
+	c.Metrics.Received(c.QueueName, lane, shard, len(records))
+
+	counts := make(map[string]int)
+	for _, r := range records {
+		counts[r.Owner]++
+		c.deliver(lane, shard, stream, group, r)
+	}
+
+	if c.ClaimNotifier != nil {
+		for from, n := range counts {
+			c.ClaimNotifier.EmitClaim(stream, from, n)
+		}
+	}
+
+	return nil
+}
+
+func heldKey(stream string, id string) string {
+	return stream + "/" + id
+}
+
+// hold 记录放入本地缓冲的消息，值表示是否已经 ack。已经持有时返回 false
+func (c *consumer) hold(m Message) bool {
+	if _, loaded := c.held.LoadOrStore(heldKey(m.Stream, m.ID), false); loaded {
+		return false
+	}
+
+	c.inflight.Add(1)
+	return true
+}
+
+// release 消息处理完成或者被丢弃。ack 的消息在 XACK 完成后才不再持有，没有 ack 的消息之后可以被回收
+func (c *consumer) release(m Message) {
+	key := heldKey(m.Stream, m.ID)
+	if acked, _ := c.held.Load(key); acked != true {
+		c.held.Delete(key)
+	}
+
+	c.inflight.Done()
+}
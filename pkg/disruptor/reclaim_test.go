@@ -0,0 +1,72 @@
+package disruptor_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/sinuxlee/tile/pkg/disruptor"
+	"github.com/sinuxlee/tile/pkg/disruptor/disruptortest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pendingOf 各个消费者没有 ack 的消息数
+func pendingOf(t *testing.T, cli redis.UniversalClient, queue string) map[string]int64 {
+	info, err := disruptor.Inspect(cli, queue, "", 0)
+	require.NoError(t, err)
+
+	res := make(map[string]int64)
+	for _, c := range info.Shards[0].Consumers {
+		res[c.Name] = c.Pending
+	}
+
+	return res
+}
+
+func TestReclaimBehindHeldEntries(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: "reclaim", ShardsCount: 1, PipePeriod: 5 * time.Millisecond}, cli)
+	require.NoError(t, err)
+	defer pr.Close()
+	for i := 0; i < 4; i++ {
+		_, err := pr.PushSync(context.Background(), pr.Value(&order{Seq: i}))
+		require.NoError(t, err)
+	}
+
+	// c1 读取前4条后暂停读取，这些消息一直在本地缓冲中，排在 PEL 的最前面
+	cn, err := disruptor.NewConsumer(&disruptor.ConsumerOptions{
+		QueueName: "reclaim", Consumer: "c1", ShardsCount: 1, Block: 10 * time.Millisecond, PipePeriod: 5 * time.Millisecond,
+		PrefetchCount: 2, HighWaterMark: 4, ClaimMinIdle: 20 * time.Millisecond, ClaimPeriod: 20 * time.Millisecond,
+	}, cli)
+	require.NoError(t, err)
+	defer cn.Close()
+
+	require.Eventually(t, func() bool { return pendingOf(t, cli, "reclaim")["c1"] == 4 }, 2*time.Second, 10*time.Millisecond)
+
+	// 下线的消费者读取了之后的3条
+	for i := 4; i < 7; i++ {
+		_, err := pr.PushSync(context.Background(), pr.Value(&order{Seq: i}))
+		require.NoError(t, err)
+	}
+
+	info, err := disruptor.Inspect(cli, "reclaim", "", 0)
+	require.NoError(t, err)
+	require.NoError(t, cli.XReadGroup(&redis.XReadGroupArgs{
+		Group: info.Group, Consumer: "dead", Streams: []string{info.Shards[0].Stream, ">"}, Count: 3,
+	}).Err())
+
+	assert.Eventually(t, func() bool { return pendingOf(t, cli, "reclaim")["c1"] == 7 }, 2*time.Second, 10*time.Millisecond)
+
+	seen := make(map[int]bool)
+	for i := 0; i < 7; i++ {
+		err, _ := cn.Pop(cn.Value(&order{}), func(m disruptor.Message) error {
+			seen[m.Data.(*order).Seq] = true
+			return nil
+		})
+		require.NoError(t, err)
+	}
+	assert.Len(t, seen, 7)
+}
@@ -0,0 +1,166 @@
+package disruptor
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// ReplayOptions 重新处理的分片和范围，id 和时间都包含边界，同时设置时使用时间
+type ReplayOptions struct {
+	QueueName string
+	Shards    []int     // 重新处理的分片，为空时使用队列描述中的全部分片
+	Start     string    // 起始的消息id，为空时从最早的消息开始
+	End       string    // 结束的消息id，为空时到最新的消息
+	Since     time.Time // 起始的写入时间
+	Until     time.Time // 结束的写入时间
+	BatchSize int64     // 每次从分片读取的消息数量
+}
+
+// rawValue 原样写入的消息体
+type rawValue []byte
+
+func (r rawValue) Marshal() ([]byte, error) {
+	return r, nil
+}
+
+func (r rawValue) Unmarshal(data []byte) error {
+	return nil
+}
+
+// Replay 按优先级和分片依次读取范围内的消息交给 h 处理，不经过消费组，也不会 ack 或者修改队列。
+// 所有消费组都 ack 后的消息会被删除，需要重新处理的队列消费者要设置 KeepAcked。
+// factory 为每条消息创建解码对象，为空时不解码，Message.Data 为 nil。
+// h 返回错误时停止，返回已经处理的消息数和该错误
+func Replay(ctx context.Context, cli redis.UniversalClient, opt *ReplayOptions, factory func() Marshaler, h Handler) (int, error) {
+	shards := opt.Shards
+	desc, err := readOrLegacyDescriptor(cli, opt.QueueName, len(shards) > 0)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(shards) == 0 {
+		for i := 0; i < desc.Shards; i++ {
+			shards = append(shards, i)
+		}
+	}
+
+	start, end := opt.Start, opt.End
+	if start == "" {
+		start = "-"
+	}
+
+	if end == "" {
+		end = "+"
+	}
+
+	// 不完整的id在起始位置表示该毫秒的第一条消息，在结束位置表示最后一条
+	if !opt.Since.IsZero() {
+		start = strconv.FormatInt(opt.Since.UnixNano()/int64(time.Millisecond), 10)
+	}
+
+	if !opt.Until.IsZero() {
+		end = strconv.FormatInt(opt.Until.UnixNano()/int64(time.Millisecond), 10)
+	}
+
+	count := opt.BatchSize
+	if count <= 0 {
+		count = 100
+	}
+
+	// 按优先级从高到低处理
+	total := 0
+	for lane := desc.Lanes - 1; lane >= 0; lane-- {
+		for _, shard := range shards {
+			stream := desc.streamName(makeLaneName(opt.QueueName, lane), shard)
+			n, err := replayShard(ctx, cli, stream, lane, shard, start, end, count, factory, h)
+			total += n
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+
+	return total, nil
+}
+
+func replayShard(ctx context.Context, cli redis.UniversalClient, stream string, lane int, shard int, start, end string,
+	count int64, factory func() Marshaler, h Handler) (int, error) {
+	total := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+
+		msgs, err := cli.XRangeN(stream, start, end, count).Result()
+		if err != nil && err != redis.Nil {
+			return total, err
+		}
+
+		for _, xm := range msgs {
+			r := decodeRecord(xm)
+			if r.Body == nil {
+				continue
+			}
+
+			m := Message{ID: r.ID, Stream: stream, Body: r.Body, Headers: r.Headers, shard: shard, lane: lane}
+			if factory != nil {
+				data := factory()
+				if err := data.Unmarshal(m.Body); err != nil {
+					return total, fmt.Errorf("disruptor: replay %v %v: %w", stream, m.ID, err)
+				}
+
+				m.Data = data
+				if v, ok := data.(*codecValue); ok {
+					m.Data = v.v
+				}
+			}
+
+			if err := h(m); err != nil {
+				return total, err
+			}
+
+			total++
+		}
+
+		if int64(len(msgs)) < count {
+			return total, nil
+		}
+
+		start = nextID(msgs[len(msgs)-1].ID)
+	}
+}
+
+// nextID 返回紧跟在 id 之后的消息id，用于 XRANGE 翻页
+func nextID(id string) string {
+	i := strings.IndexByte(id, '-')
+	if i < 0 {
+		return id
+	}
+
+	seq, _ := strconv.ParseUint(id[i+1:], 10, 64)
+	return fmt.Sprintf("%v-%v", id[:i], seq+1)
+}
+
+// Republish 把范围内的消息按原来的消息体、消息头和优先级写入 pr 的队列。
+// 重新发布的消息使用新的消息id，不会被去重跳过，原来的消息id保存在 HeaderOriginMessageID 中，多次重新发布时保留最初的id。
+// 同一个分片的消息写入 pr 的同一个分片，保持原来的顺序。pr 写入原队列时需要设置 End 或者 Until
+func Republish(ctx context.Context, cli redis.UniversalClient, opt *ReplayOptions, pr Producer) (int, error) {
+	return Replay(ctx, cli, opt, nil, func(m Message) error {
+		h := make(Headers, len(m.Headers)+1)
+		for k, v := range m.Headers {
+			h[k] = v
+		}
+
+		if id := h.Get(HeaderMessageID); id != "" && h.Get(HeaderOriginMessageID) == "" {
+			h[HeaderOriginMessageID] = id
+		}
+		delete(h, HeaderMessageID)
+
+		return pr.PushContext(ctx, rawValue(m.Body), WithHeaders(h), WithKey(m.Stream), WithPriority(m.lane))
+	})
+}
@@ -0,0 +1,116 @@
+package disruptor_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sinuxlee/tile/pkg/disruptor"
+	"github.com/sinuxlee/tile/pkg/disruptor/disruptortest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type order struct {
+	Seq int `json:"seq"`
+}
+
+func TestReplay(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+	ctx := context.Background()
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: "orders", ShardsCount: 1, PipePeriod: 5 * time.Millisecond}, cli)
+	require.NoError(t, err)
+	cn, err := disruptor.NewConsumer(&disruptor.ConsumerOptions{
+		QueueName: "orders", Consumer: "c1", ShardsCount: 1, Block: 10 * time.Millisecond, PipePeriod: 5 * time.Millisecond, KeepAcked: true,
+	}, cli)
+	require.NoError(t, err)
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		id, err := pr.PushSync(ctx, pr.Value(&order{Seq: i}))
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	pr.Close()
+
+	for i := 0; i < 5; i++ {
+		err, _ := cn.Pop(cn.Value(&order{}), func(m disruptor.Message) error { return nil })
+		require.NoError(t, err)
+	}
+	cn.Close()
+
+	// ack 后保留的消息可以按id范围重新处理
+	var seqs []int
+	n, err := disruptor.Replay(ctx, cli, &disruptor.ReplayOptions{QueueName: "orders", Start: ids[1], End: ids[3], BatchSize: 2},
+		func() disruptor.Marshaler { return cn.Value(&order{}) },
+		func(m disruptor.Message) error {
+			seqs = append(seqs, m.Data.(*order).Seq)
+			return nil
+		})
+
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, []int{1, 2, 3}, seqs)
+
+	// 重新发布到另一个队列，消息id以外的消息头保持不变
+	to, err := disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: "orders_fix", ShardsCount: 1, PipePeriod: 5 * time.Millisecond}, cli)
+	require.NoError(t, err)
+	fix, err := disruptor.NewConsumer(&disruptor.ConsumerOptions{
+		QueueName: "orders_fix", Consumer: "c1", ShardsCount: 1, Block: 10 * time.Millisecond, PipePeriod: 5 * time.Millisecond,
+	}, cli)
+	require.NoError(t, err)
+	defer fix.Close()
+
+	n, err = disruptor.Republish(ctx, cli, &disruptor.ReplayOptions{QueueName: "orders", Since: time.Now().Add(-time.Hour)}, to)
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	to.Close()
+
+	for i := 0; i < 5; i++ {
+		err, _ := fix.Pop(fix.Value(&order{}), func(m disruptor.Message) error {
+			assert.Equal(t, i, m.Data.(*order).Seq)
+			assert.Equal(t, "json", m.Headers.Get(disruptor.HeaderContentType))
+			return nil
+		})
+		require.NoError(t, err)
+	}
+}
+
+func TestRepublishDedup(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+	ctx := context.Background()
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: "payments", ShardsCount: 1, PipePeriod: 5 * time.Millisecond}, cli)
+	require.NoError(t, err)
+	defer pr.Close()
+	cn, err := disruptor.NewConsumer(&disruptor.ConsumerOptions{
+		QueueName: "payments", Consumer: "c1", ShardsCount: 1, Block: 10 * time.Millisecond, PipePeriod: 5 * time.Millisecond,
+		KeepAcked: true, DedupWindow: time.Minute,
+	}, cli)
+	require.NoError(t, err)
+	defer cn.Close()
+
+	end, err := pr.PushSync(ctx, pr.Value(&order{Seq: 1}))
+	require.NoError(t, err)
+
+	var first disruptor.Headers
+	require.NoError(t, popTimeout(cn, func(m disruptor.Message) error {
+		first = m.Headers
+		return nil
+	}))
+
+	// 重新发布到原队列，开启去重的消费者仍然处理
+	n, err := disruptor.Republish(ctx, cli, &disruptor.ReplayOptions{QueueName: "payments", End: end}, pr)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	calls := 0
+	require.NoError(t, popTimeout(cn, func(m disruptor.Message) error {
+		calls++
+		assert.NotEqual(t, first.Get(disruptor.HeaderMessageID), m.Headers.Get(disruptor.HeaderMessageID))
+		assert.Equal(t, first.Get(disruptor.HeaderMessageID), m.Headers.Get(disruptor.HeaderOriginMessageID))
+		return nil
+	}))
+	assert.Equal(t, 1, calls)
+}
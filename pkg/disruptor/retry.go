@@ -0,0 +1,135 @@
+package disruptor
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// RetryPolicy 消息处理失败后的重试策略
+type RetryPolicy struct {
+	MaxAttempts int           // 最多处理的次数，包含第一次
+	Backoff     time.Duration // 第一次重试前等待的时长，之后每次翻倍
+	MaxBackoff  time.Duration // 重试等待的最长时间
+}
+
+func (r *RetryPolicy) delay(attempts int) time.Duration {
+	d := r.Backoff
+	for i := 1; i < attempts && d < r.MaxBackoff; i++ {
+		d *= 2
+	}
+
+	if d > r.MaxBackoff {
+		d = r.MaxBackoff
+	}
+
+	return d
+}
+
+// handle 解码并处理消息，失败时按重试策略重试，最终失败的消息进入死信队列
+func (c *consumer) handle(m Message, data Marshaler, h Handler) error {
+	defer c.release(m)
+
+	if c.DedupWindow > 0 {
+		ok, err := c.dedupBegin(m)
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	m, err := decodeMessage(m, data)
+	if err != nil {
+		// 解码失败重试也没有意义，直接进入死信队列
+		c.fail(m, err, 1)
+		return err
+	}
+
+	return retryMessage(m, h, &c.Retry, func(m Message) {
+		c.dedupEnd(m, true)
+		c.ack(m)
+	}, c.fail)
+}
+
+// retryMessage 在当前协程中同步重试，两次处理之间按 retry 的退避时间等待，不释放消息。
+// 成功时交给 ack，处理 MaxAttempts 次仍然失败时交给 fail，返回最后一次处理的错误
+func retryMessage(m Message, h Handler, retry *RetryPolicy, ack func(m Message),
+	fail func(m Message, cause error, attempts int)) error {
+	attempts := 0
+	for {
+		attempts++
+		err := h(m)
+		if err == nil {
+			ack(m)
+			return nil
+		}
+
+		if attempts >= retry.MaxAttempts {
+			fail(m, err, attempts)
+			return err
+		}
+
+		time.Sleep(retry.delay(attempts))
+	}
+}
+
+// deadLetterHeaders 死信消息的消息头，在原消息头之外记录失败原因、处理次数和原队列中的位置
+func deadLetterHeaders(m Message, cause error, attempts int) Headers {
+	h := make(Headers, len(m.Headers)+4)
+	for k, v := range m.Headers {
+		h[k] = v
+	}
+
+	h[HeaderError] = cause.Error()
+	h[HeaderAttempts] = strconv.Itoa(attempts)
+	h[HeaderOriginID] = m.ID
+	h[HeaderOriginStream] = m.Stream
+
+	return h
+}
+
+// fail 把处理失败的消息写入死信队列后再ack，写入失败的消息留在 PEL 中等待重新投递
+func (c *consumer) fail(m Message, cause error, attempts int) {
+	c.Metrics.HandleFailed(c.QueueName, m.lane, m.shard)
+
+	if !c.DeadLetter {
+		c.dedupEnd(m, true)
+		c.ack(m)
+		return
+	}
+
+	err := c.redisClient.XAdd(&redis.XAddArgs{
+		ID:     "*",
+		Stream: makeDeadLetterName(c.QueueName),
+		Values: encodeFields(m.Body, deadLetterHeaders(m, cause, attempts)),
+	}).Err()
+
+	if err != nil {
+		if c.emitter != nil {
+			c.emitter.EmitError(err)
+		}
+
+		c.dedupEnd(m, false)
+		return
+	}
+
+	c.dedupEnd(m, true)
+	c.ack(m)
+}
+
+// DeadLetters 读取 Redis 死信队列中的所有消息，消息头中记录了失败原因、处理次数和原队列中的位置
+func DeadLetters(cli redis.UniversalClient, queue string) ([]Message, error) {
+	stream := makeDeadLetterName(queue)
+	msgs, err := cli.XRange(stream, "-", "+").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]Message, len(msgs))
+	for i, m := range msgs {
+		r := decodeRecord(m)
+		res[i] = Message{ID: r.ID, Stream: stream, Body: r.Body, Headers: r.Headers}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,87 @@
+package disruptor_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sinuxlee/tile/pkg/disruptor"
+	"github.com/sinuxlee/tile/pkg/disruptor/disruptortest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryDeadLetter(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: "events", ShardsCount: 1, PipePeriod: 5 * time.Millisecond}, cli)
+	require.NoError(t, err)
+	defer pr.Close()
+	cn, err := disruptor.NewConsumer(&disruptor.ConsumerOptions{
+		QueueName: "events", Consumer: "c1", ShardsCount: 1, Block: 10 * time.Millisecond, PipePeriod: 5 * time.Millisecond,
+		DeadLetter: true, Retry: disruptor.RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond},
+	}, cli)
+	require.NoError(t, err)
+	defer cn.Close()
+
+	id, err := pr.PushSync(context.Background(), pr.Value(&order{Seq: 1}))
+	require.NoError(t, err)
+
+	calls := 0
+	err = popTimeout(cn, func(m disruptor.Message) error {
+		calls++
+		return errors.New("handler failed")
+	})
+	assert.EqualError(t, err, "handler failed")
+	assert.Equal(t, 3, calls)
+
+	// 达到最多处理次数后写入死信队列，保留消息体、消息头、失败原因和处理次数，原消息 ack
+	dead, err := disruptor.DeadLetters(cli, "events")
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	h := dead[0].Headers
+	assert.Equal(t, `{"seq":1}`, string(dead[0].Body))
+	assert.Equal(t, "json", h.Get(disruptor.HeaderContentType))
+	assert.Equal(t, "handler failed", h.Get(disruptor.HeaderError))
+	assert.Equal(t, "3", h.Get(disruptor.HeaderAttempts))
+	assert.Equal(t, id, h.Get(disruptor.HeaderOriginID))
+
+	info, err := disruptor.Inspect(cli, "events", "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, info.Shards[0].Stream, h.Get(disruptor.HeaderOriginStream))
+	assert.Eventually(t, func() bool {
+		info, err := disruptor.Inspect(cli, "events", "", 0)
+		return err == nil && info.Pending == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestRetryDecodeFailed(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: "broken", ShardsCount: 1, PipePeriod: 5 * time.Millisecond}, cli)
+	require.NoError(t, err)
+	defer pr.Close()
+	cn, err := disruptor.NewConsumer(&disruptor.ConsumerOptions{
+		QueueName: "broken", Consumer: "c1", ShardsCount: 1, Block: 10 * time.Millisecond, PipePeriod: 5 * time.Millisecond,
+		DeadLetter: true, Retry: disruptor.RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond},
+	}, cli)
+	require.NoError(t, err)
+	defer cn.Close()
+
+	_, err = pr.PushSync(context.Background(), pr.Value("not an order"))
+	require.NoError(t, err)
+
+	// 解码失败不重试，直接进入死信队列
+	calls := 0
+	assert.Error(t, popTimeout(cn, func(m disruptor.Message) error {
+		calls++
+		return nil
+	}))
+	assert.Equal(t, 0, calls)
+
+	dead, err := disruptor.DeadLetters(cli, "broken")
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	assert.Equal(t, "1", dead[0].Headers.Get(disruptor.HeaderAttempts))
+}
@@ -0,0 +1,425 @@
+package disruptor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/imdario/mergo"
+)
+
+// ErrNoReplyTo 请求方没有设置接收回复的队列
+var ErrNoReplyTo = errors.New("disruptor: requester needs a reply-to queue")
+
+var defaultRequesterOptions = RequesterOptions{
+	Timeout: 10 * time.Second, // 等待回复的最长时间
+}
+
+// RequesterOptions 请求方的配置
+type RequesterOptions struct {
+	ReplyTo       string                // 接收回复的队列，每个请求方使用不同的队列
+	Timeout       time.Duration         // ctx 没有更早的截止时间时等待回复的最长时间
+	Client        redis.UniversalClient // 设置时 Close 通过 DeleteQueue 删除 ReplyTo 队列，其他后端不设置
+	ErrorNotifier ErrorNotifier
+}
+
+// Requester 请求/回复模式的请求方，请求写入处理方消费的队列，回复由处理方写入 ReplyTo 队列
+type Requester interface {
+	// Request 发送请求并等待回复，回复解码到 reply。超时时返回 context.DeadlineExceeded，
+	// 处理方返回错误时返回 *RemoteError
+	Request(ctx context.Context, req Marshaler, reply Marshaler, opts ...PushOption) error
+	// Close 关闭回复队列的消费者，设置了 Client 时删除回复队列，等待中的请求返回 ErrClosed。
+	// pr 由调用方关闭，可以多次调用
+	Close()
+}
+
+// RemoteError 处理方处理请求失败的原因
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("disruptor: remote error: %v", e.Message)
+}
+
+type requester struct {
+	*RequesterOptions
+	pr Producer
+	cn Consumer
+
+	mu        sync.Mutex
+	calls     map[string]chan Message // 等待回复的请求，key 为 correlation id
+	closing   chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewRequester pr 写入请求队列，cn 消费 opt.ReplyTo 队列，ReplyTo 为空时返回 ErrNoReplyTo
+func NewRequester(pr Producer, cn Consumer, opt *RequesterOptions) (Requester, error) {
+	if opt.ReplyTo == "" {
+		return nil, ErrNoReplyTo
+	}
+
+	if err := mergo.Merge(opt, defaultRequesterOptions); err != nil {
+		return nil, err
+	}
+
+	r := &requester{
+		RequesterOptions: opt,
+		pr:               pr,
+		cn:               cn,
+		calls:            make(map[string]chan Message),
+		closing:          make(chan struct{}),
+		closed:           make(chan struct{}),
+	}
+
+	go func() {
+		_ = cn.Run(context.Background(), 1, func() Marshaler { return rawValue(nil) }, r.route)
+		close(r.closed)
+	}()
+
+	return r, nil
+}
+
+// route 把回复交给等待中的请求，超时之后才到达的回复直接丢弃
+func (r *requester) route(m Message) error {
+	r.mu.Lock()
+	ch, ok := r.calls[m.Headers.Get(HeaderCorrelationID)]
+	r.mu.Unlock()
+
+	if ok {
+		select {
+		case ch <- m:
+		default:
+		}
+	}
+
+	return nil
+}
+
+func (r *requester) Request(ctx context.Context, req Marshaler, reply Marshaler, opts ...PushOption) error {
+	id, err := newMessageID()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	ch := make(chan Message, 1)
+	r.mu.Lock()
+	r.calls[id] = ch
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		delete(r.calls, id)
+		r.mu.Unlock()
+	}()
+
+	opts = append(opts, WithHeader(HeaderCorrelationID, id), WithHeader(HeaderReplyTo, r.ReplyTo))
+	if err := r.pr.PushContext(ctx, req, opts...); err != nil {
+		return err
+	}
+
+	select {
+	case m := <-ch:
+		if msg, ok := m.Headers[HeaderReplyError]; ok {
+			return &RemoteError{Message: msg}
+		}
+
+		return reply.Unmarshal(m.Body)
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.closing:
+		return ErrClosed
+	}
+}
+
+func (r *requester) Close() {
+	r.closeOnce.Do(func() {
+		close(r.closing)
+		r.cn.Close()
+		<-r.closed
+
+		// 回复队列只有这个请求方使用，不删除时会一直留在 Redis 中
+		if r.Client == nil {
+			return
+		}
+
+		if err := DeleteQueue(r.Client, r.ReplyTo); err != nil && r.ErrorNotifier != nil {
+			r.ErrorNotifier.EmitError(err)
+		}
+	})
+
+	<-r.closed
+}
+
+// ReplyHandler 处理请求，返回的 Marshaler 作为回复的消息体
+type ReplyHandler func(m Message) (Marshaler, error)
+
+var defaultResponderOptions = ResponderOptions{
+	ReplyTimeout: 5 * time.Second, // 写入一条回复的最长时间
+	KeepUnsent:   time.Minute,     // 写入失败的回复保留的时长
+	IdleTimeout:  time.Minute,     // 回复队列的生产者空闲多久后关闭
+}
+
+// ResponderOptions 处理方的配置
+type ResponderOptions struct {
+	ReplyTimeout time.Duration // 等待一条回复写入队列的最长时间，超过后按写入失败处理。也是关闭一个回复队列生产者的最长时间
+	KeepUnsent   time.Duration // 写入失败的回复保留的时长，请求在这段时间内重新投递时只重新写入回复
+	IdleTimeout  time.Duration // 回复队列的生产者超过该时间没有写入时关闭，之后有回复时重新创建
+	// 设置时只回复到存在的队列，请求方关闭并删除回复队列后才到达的回复直接丢弃，不会重新创建队列。其他后端不设置
+	Client        redis.UniversalClient
+	ErrorNotifier ErrorNotifier // 关闭回复队列的生产者失败时通知
+}
+
+// Responder 请求/回复模式的处理方，按请求中的 reply-to 把回复写入请求方的队列
+type Responder interface {
+	// Handler 把 h 包装成消费者使用的 Handler。h 返回的错误作为 *RemoteError 回复给请求方，
+	// 请求本身处理完成，不会重试；回复写入失败时返回错误，由消费者按重试策略重新投递请求，
+	// KeepUnsent 内重新投递到同一个处理方时不再调用 h，只重新写入保留的回复。
+	// 回复写入本地文件时按写入成功处理。没有 reply-to 的消息不回复，h 返回的错误和普通 Handler 一样处理
+	Handler(h ReplyHandler) Handler
+	// Close 关闭所有回复队列的生产者，每个生产者最多等待 ReplyTimeout
+	Close()
+}
+
+type responder struct {
+	*ResponderOptions
+	newProducer func(queue string) (Producer, error)
+
+	mu        sync.Mutex
+	producers map[string]*replyProducer
+	unsent    map[string]*unsentReply // 写入失败的回复，key 为请求所在的分片和id
+	closing   sync.WaitGroup          // 正在关闭的空闲生产者
+}
+
+// replyProducer 回复队列的生产者
+type replyProducer struct {
+	pr    Producer
+	users int       // 正在写入回复的数量，为0时才能关闭
+	used  time.Time // 最后一次写入完成的时间
+}
+
+// unsentReply 写入失败的回复
+type unsentReply struct {
+	body    Marshaler
+	opts    []PushOption
+	expires time.Time
+}
+
+// NewResponder newProducer 为 reply-to 队列创建生产者，空闲超过 IdleTimeout 后关闭，opt 为 nil 时使用默认配置。
+// 回复队列只在请求方运行时有消费者，newProducer 创建的生产者应该设置 MaxLen 或者 MaxAge
+func NewResponder(newProducer func(queue string) (Producer, error), opt *ResponderOptions) (Responder, error) {
+	if opt == nil {
+		opt = &ResponderOptions{}
+	}
+
+	if err := mergo.Merge(opt, defaultResponderOptions); err != nil {
+		return nil, err
+	}
+
+	return &responder{
+		ResponderOptions: opt,
+		newProducer:      newProducer,
+		producers:        make(map[string]*replyProducer),
+		unsent:           make(map[string]*unsentReply),
+	}, nil
+}
+
+func (r *responder) Handler(h ReplyHandler) Handler {
+	return func(m Message) error {
+		replyTo := m.Headers.Get(HeaderReplyTo)
+		if replyTo == "" {
+			_, err := h(m)
+			return err
+		}
+
+		key := heldKey(m.Stream, m.ID)
+		reply := r.takeUnsent(key)
+		if reply == nil {
+			reply = makeReply(h, m)
+		}
+
+		err := r.send(replyTo, reply)
+		if err != nil {
+			r.keepUnsent(key, reply)
+		}
+
+		return err
+	}
+}
+
+// makeReply 处理请求，h 返回的错误作为回复
+func makeReply(h ReplyHandler, m Message) *unsentReply {
+	res, err := h(m)
+
+	opts := []PushOption{WithHeader(HeaderCorrelationID, m.Headers.Get(HeaderCorrelationID))}
+	if err != nil {
+		res = rawValue([]byte{})
+		opts = append(opts, WithHeader(HeaderReplyError, err.Error()))
+	} else if res == nil {
+		res = rawValue([]byte{})
+	}
+
+	return &unsentReply{body: res, opts: opts}
+}
+
+// send 在 ReplyTimeout 内等待回复写入队列，写入失败时请求不会被 ack。回复队列已经删除时丢弃回复
+func (r *responder) send(replyTo string, reply *unsentReply) error {
+	if r.Client != nil {
+		n, err := r.Client.Exists(makeMetaName(replyTo)).Result()
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			r.discard(replyTo)
+			return nil
+		}
+	}
+
+	rp, err := r.acquire(replyTo)
+	if err != nil {
+		return err
+	}
+	defer r.release(rp)
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.ReplyTimeout)
+	defer cancel()
+
+	// 写入本地文件的回复在 Redis 恢复后发送，重新处理请求只会产生重复的回复
+	_, err = rp.pr.PushSync(ctx, reply.body, reply.opts...)
+	if err == ErrSpilled {
+		return nil
+	}
+
+	return err
+}
+
+// takeUnsent 取出请求之前写入失败的回复，没有或者已经过期时返回 nil
+func (r *responder) takeUnsent(key string) *unsentReply {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reply, ok := r.unsent[key]
+	if !ok {
+		return nil
+	}
+
+	delete(r.unsent, key)
+	if time.Now().After(reply.expires) {
+		return nil
+	}
+
+	return reply
+}
+
+// keepUnsent 保留写入失败的回复，同时清理过期的回复，重新投递到其他处理方的请求不会再回到这里
+func (r *responder) keepUnsent(key string, reply *unsentReply) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for k, v := range r.unsent {
+		if now.After(v.expires) {
+			delete(r.unsent, k)
+		}
+	}
+
+	reply.expires = now.Add(r.KeepUnsent)
+	r.unsent[key] = reply
+}
+
+// acquire 返回回复队列的生产者，同时在后台关闭空闲超过 IdleTimeout 的生产者
+func (r *responder) acquire(queue string) (*replyProducer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	var idle []Producer
+	for q, rp := range r.producers {
+		if rp.users == 0 && now.Sub(rp.used) > r.IdleTimeout {
+			idle = append(idle, rp.pr)
+			delete(r.producers, q)
+		}
+	}
+	r.closeLater(idle)
+
+	rp, ok := r.producers[queue]
+	if !ok {
+		pr, err := r.newProducer(queue)
+		if err != nil {
+			return nil, err
+		}
+
+		rp = &replyProducer{pr: pr}
+		r.producers[queue] = rp
+	}
+
+	rp.users++
+	return rp, nil
+}
+
+func (r *responder) release(rp *replyProducer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rp.users--
+	rp.used = time.Now()
+}
+
+// discard 关闭已经删除的回复队列的生产者，正在使用的生产者等空闲后关闭
+func (r *responder) discard(queue string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if rp, ok := r.producers[queue]; ok && rp.users == 0 {
+		delete(r.producers, queue)
+		r.closeLater([]Producer{rp.pr})
+	}
+}
+
+// closeLater 在后台关闭生产者，调用时持有 r.mu
+func (r *responder) closeLater(producers []Producer) {
+	if len(producers) == 0 {
+		return
+	}
+
+	r.closing.Add(1)
+	go func() {
+		defer r.closing.Done()
+		r.closeProducers(producers)
+	}()
+}
+
+// closeProducers 每个生产者最多等待 ReplyTimeout 发送剩下的回复
+func (r *responder) closeProducers(producers []Producer) {
+	for _, pr := range producers {
+		ctx, cancel := context.WithTimeout(context.Background(), r.ReplyTimeout)
+		dropped, err := pr.CloseContext(ctx)
+		cancel()
+
+		if err != nil && r.ErrorNotifier != nil {
+			r.ErrorNotifier.EmitError(fmt.Errorf("disruptor: close reply producer, %v replies dropped: %w", dropped, err))
+		}
+	}
+}
+
+// Close 在锁外关闭生产者，关闭时不阻塞其他回复查找生产者
+func (r *responder) Close() {
+	r.mu.Lock()
+	producers := make([]Producer, 0, len(r.producers))
+	for queue, rp := range r.producers {
+		producers = append(producers, rp.pr)
+		delete(r.producers, queue)
+	}
+	r.mu.Unlock()
+
+	r.closeProducers(producers)
+	r.closing.Wait()
+}
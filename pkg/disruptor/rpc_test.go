@@ -0,0 +1,193 @@
+package disruptor_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sinuxlee/tile/pkg/disruptor"
+	"github.com/sinuxlee/tile/pkg/disruptor/disruptortest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestReply(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+	newProducer := func(queue string) (disruptor.Producer, error) {
+		return disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: queue, ShardsCount: 1, PipePeriod: time.Millisecond}, cli)
+	}
+
+	newConsumer := func(queue string) disruptor.Consumer {
+		cn, err := disruptor.NewConsumer(&disruptor.ConsumerOptions{
+			QueueName: queue, Consumer: "c1", ShardsCount: 1, Block: 10 * time.Millisecond, PipePeriod: time.Millisecond,
+		}, cli)
+		require.NoError(t, err)
+
+		return cn
+	}
+
+	// 处理方把订单号加倍后回复，负数返回错误
+	server := newConsumer("rpc")
+	responder, err := disruptor.NewResponder(newProducer, nil)
+	require.NoError(t, err)
+	defer responder.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = server.Run(ctx, 2, func() disruptor.Marshaler { return server.Value(&order{}) },
+			responder.Handler(func(m disruptor.Message) (disruptor.Marshaler, error) {
+				o := m.Data.(*order)
+				if o.Seq < 0 {
+					return nil, errors.New("negative seq")
+				}
+
+				return server.Value(&order{Seq: o.Seq * 2}), nil
+			}))
+	}()
+	defer server.Close()
+
+	pr, err := newProducer("rpc")
+	require.NoError(t, err)
+	defer pr.Close()
+
+	rq, err := disruptor.NewRequester(pr, newConsumer("rpc:reply:c1"), &disruptor.RequesterOptions{ReplyTo: "rpc:reply:c1", Timeout: 2 * time.Second})
+	require.NoError(t, err)
+	defer rq.Close()
+
+	reply := &order{}
+	require.NoError(t, rq.Request(context.Background(), pr.Value(&order{Seq: 21}), pr.Value(reply)))
+	assert.Equal(t, 42, reply.Seq)
+
+	err = rq.Request(context.Background(), pr.Value(&order{Seq: -1}), pr.Value(reply))
+	var remote *disruptor.RemoteError
+	require.True(t, errors.As(err, &remote))
+	assert.Equal(t, "negative seq", remote.Message)
+
+	// 没有处理方的队列等待到超时
+	idle, err := newProducer("rpc_idle")
+	require.NoError(t, err)
+	defer idle.Close()
+
+	rq2, err := disruptor.NewRequester(idle, newConsumer("rpc:reply:c2"), &disruptor.RequesterOptions{ReplyTo: "rpc:reply:c2", Timeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+	defer rq2.Close()
+
+	assert.Equal(t, context.DeadlineExceeded, rq2.Request(context.Background(), idle.Value(&order{}), idle.Value(reply)))
+}
+
+func TestRequesterClose(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: "rpc_close", ShardsCount: 1}, cli)
+	require.NoError(t, err)
+	defer pr.Close()
+
+	cn, err := disruptor.NewConsumer(&disruptor.ConsumerOptions{QueueName: "rpc_close:reply", Consumer: "c1", ShardsCount: 1, Block: 10 * time.Millisecond}, cli)
+	require.NoError(t, err)
+
+	_, err = disruptor.NewRequester(pr, cn, &disruptor.RequesterOptions{})
+	assert.Equal(t, disruptor.ErrNoReplyTo, err)
+
+	rq, err := disruptor.NewRequester(pr, cn, &disruptor.RequesterOptions{ReplyTo: "rpc_close:reply", Client: cli})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, cli.Exists("disruptor:rpc_close:reply:meta").Val())
+	rq.Close()
+	rq.Close()
+
+	// 关闭后删除回复队列
+	keys, err := cli.Keys("disruptor:rpc_close:reply*").Result()
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestResponderReplyFailed(t *testing.T) {
+	mr, cli := disruptortest.NewRedis(t)
+	responder, err := disruptor.NewResponder(func(queue string) (disruptor.Producer, error) {
+		return disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: queue, ShardsCount: 1, PipePeriod: time.Millisecond}, cli)
+	}, &disruptor.ResponderOptions{ReplyTimeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+	defer responder.Close()
+
+	calls := 0
+	h := responder.Handler(func(m disruptor.Message) (disruptor.Marshaler, error) {
+		calls++
+		return nil, nil
+	})
+
+	// 回复写入成功后请求才处理完成
+	m := disruptor.Message{ID: "1-0", Stream: "rpc", Headers: disruptor.Headers{disruptor.HeaderReplyTo: "rpc_fail:reply", disruptor.HeaderCorrelationID: "1"}}
+	require.NoError(t, h(m))
+	assert.Equal(t, 1, calls)
+
+	// 生产者一直重试时最多等待 ReplyTimeout
+	m.ID = "2-0"
+	mr.SetError("LOADING down")
+	started := time.Now()
+	assert.Equal(t, context.DeadlineExceeded, h(m))
+	assert.Less(t, int64(time.Since(started)), int64(time.Second))
+	mr.SetError("")
+
+	// 重新投递的请求只重新写入回复，不再处理
+	assert.Eventually(t, func() bool { return h(m) == nil }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, calls)
+}
+
+func TestResponderDeletedReplyTo(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+	responder, err := disruptor.NewResponder(func(queue string) (disruptor.Producer, error) {
+		return disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: queue, ShardsCount: 1, PipePeriod: time.Millisecond}, cli)
+	}, &disruptor.ResponderOptions{Client: cli})
+	require.NoError(t, err)
+	defer responder.Close()
+
+	calls := 0
+	h := responder.Handler(func(m disruptor.Message) (disruptor.Marshaler, error) {
+		calls++
+		return nil, nil
+	})
+
+	// 请求方运行时回复队列已经创建
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: "rpc_gone:reply", ShardsCount: 1}, cli)
+	require.NoError(t, err)
+	pr.Close()
+
+	m := disruptor.Message{ID: "1-0", Stream: "rpc", Headers: disruptor.Headers{disruptor.HeaderReplyTo: "rpc_gone:reply", disruptor.HeaderCorrelationID: "1"}}
+	require.NoError(t, h(m))
+	assert.EqualValues(t, 1, cli.Exists("disruptor:rpc_gone:reply:{rpc_gone:reply}:0").Val())
+
+	// 请求方关闭后到达的请求照常处理，回复丢弃，不会重新创建回复队列
+	require.NoError(t, disruptor.DeleteQueue(cli, "rpc_gone:reply"))
+	m.ID = "2-0"
+	require.NoError(t, h(m))
+	assert.Equal(t, 2, calls)
+
+	keys, err := cli.Keys("disruptor:rpc_gone:reply*").Result()
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestResponderIdleProducer(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+	created := 0
+	responder, err := disruptor.NewResponder(func(queue string) (disruptor.Producer, error) {
+		created++
+		return disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: queue, ShardsCount: 1, PipePeriod: time.Millisecond}, cli)
+	}, &disruptor.ResponderOptions{IdleTimeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+	defer responder.Close()
+
+	h := responder.Handler(func(m disruptor.Message) (disruptor.Marshaler, error) {
+		return nil, nil
+	})
+
+	m := disruptor.Message{ID: "1-0", Stream: "rpc", Headers: disruptor.Headers{disruptor.HeaderReplyTo: "rpc_idle:reply", disruptor.HeaderCorrelationID: "1"}}
+	require.NoError(t, h(m))
+	require.NoError(t, h(m))
+	assert.Equal(t, 1, created)
+
+	// 空闲超过 IdleTimeout 的生产者关闭，之后的回复重新创建
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, h(m))
+	assert.Equal(t, 2, created)
+}
@@ -0,0 +1,405 @@
+package disruptor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// segmentSize 段文件超过该大小后写入新的段文件
+const segmentSize = 64 << 20
+
+// spillRecord 写入段文件的一条消息
+type spillRecord struct {
+	Lane    int     `json:"lane,omitempty"`
+	Shard   int     `json:"shard"`
+	Body    []byte  `json:"body"`
+	Headers Headers `json:"headers,omitempty"`
+}
+
+// spiller Redis 不可用时把批次按顺序追加到本地的段文件，段文件名中的序号递增，
+// 只要还有段文件没有重新发送，新的批次也写入段文件。
+// 每个队列的段文件在 SpillDir 中各自的子目录里，只能由一个生产者写入，通过锁文件保证
+type spiller struct {
+	dir  string
+	lock *os.File // 持有锁的锁文件，关闭后为 nil
+
+	mu     sync.Mutex
+	active bool     // 是否还有没重新发送的段文件
+	file   *os.File // 正在写入的段文件
+	size   int64
+	seq    uint64
+}
+
+func newSpiller(dir string, queue string) (*spiller, error) {
+	dir = filepath.Join(dir, spillDirName(queue))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	lock, err := lockDir(filepath.Join(dir, "lock"))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &spiller{dir: dir, lock: lock}
+	segs, err := s.segments()
+	if err != nil {
+		_ = unlockDir(lock)
+		return nil, err
+	}
+
+	// 上次运行时留下的段文件需要先重新发送
+	if len(segs) != 0 {
+		seq, err := seqOf(segs[len(segs)-1])
+		if err != nil {
+			_ = unlockDir(lock)
+			return nil, err
+		}
+
+		s.active = true
+		s.seq = seq + 1
+	}
+
+	return s, nil
+}
+
+// spillDirName 队列的段文件所在的子目录名，转义路径中的特殊字符，"." 也转义，队列名不会成为 "." 或者 ".."
+func spillDirName(queue string) string {
+	return strings.ReplaceAll(url.PathEscape(queue), ".", "%2E")
+}
+
+// segments 按写入顺序返回所有段文件，只包含文件名为序号的文件
+func (s *spiller) segments() ([]string, error) {
+	d, err := os.Open(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := d.Readdirnames(-1)
+	_ = d.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var segs []string
+	for _, name := range names {
+		if segmentPattern.MatchString(name) {
+			segs = append(segs, filepath.Join(s.dir, name))
+		}
+	}
+
+	// 序号的长度固定，按文件名排序就是写入顺序
+	sort.Strings(segs)
+	return segs, nil
+}
+
+// segmentPattern 段文件名是固定20位的序号
+var segmentPattern = regexp.MustCompile(`^[0-9]{20}\.seg$`)
+
+func seqOf(seg string) (uint64, error) {
+	seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(seg), ".seg"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("disruptor: invalid segment %v: %w", seg, err)
+	}
+
+	return seq, nil
+}
+
+// write 把批次追加到段文件，force 为 false 时只在还有段文件没重新发送时写入，返回是否写入
+func (s *spiller) write(b *sendBatch, force bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.active && !force {
+		return false, nil
+	}
+
+	s.active = true
+	if s.file == nil {
+		name := filepath.Join(s.dir, fmt.Sprintf("%020d.seg", s.seq))
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return true, err
+		}
+
+		// 新的段文件在目录中的记录也要落盘，否则掉电后整个段文件可能丢失
+		if err := syncDir(s.dir); err != nil {
+			_ = f.Close()
+			return true, err
+		}
+
+		s.file = f
+		s.size = 0
+	}
+
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, m := range b.msgs {
+		if err := enc.Encode(&spillRecord{Lane: b.lane, Shard: b.shard, Body: m.body, Headers: m.headers}); err != nil {
+			return true, err
+		}
+	}
+
+	n, err := s.file.Write(buf.Bytes())
+	s.size += int64(n)
+	if err != nil {
+		return true, err
+	}
+
+	// 返回 ErrSpilled 之前消息已经落盘
+	if err := s.file.Sync(); err != nil {
+		return true, err
+	}
+
+	if s.size >= segmentSize {
+		s.rotate()
+	}
+
+	return true, nil
+}
+
+// rotate 关闭正在写入的段文件，之后的批次写入新的段文件
+func (s *spiller) rotate() {
+	if s.file == nil {
+		return
+	}
+
+	_ = s.file.Close()
+	s.file = nil
+	s.seq++
+}
+
+// seal 关闭正在写入的段文件，返回可以重新发送的段文件
+func (s *spiller) seal() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.active {
+		return nil, nil
+	}
+
+	s.rotate()
+	return s.segments()
+}
+
+// finish 重新发送后没有新的段文件时，之后的批次直接发送
+func (s *spiller) finish() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	segs, err := s.segments()
+	if err != nil {
+		return err
+	}
+
+	if s.file == nil && len(segs) == 0 {
+		s.active = false
+	}
+
+	return nil
+}
+
+// close 关闭正在写入的段文件并释放目录的锁
+func (s *spiller) close() {
+	s.mu.Lock()
+	s.rotate()
+	if s.lock != nil {
+		_ = unlockDir(s.lock)
+		s.lock = nil
+	}
+	s.mu.Unlock()
+}
+
+// spilled 批次写入段文件后通知发送结果，写入失败时消息丢失
+func (p *producer) spilled(b *sendBatch, err error) {
+	if err != nil {
+		if p.emitter != nil {
+			p.emitter.EmitError(err)
+		}
+
+		p.lost(b)
+	} else {
+		err = ErrSpilled
+	}
+
+	for _, m := range b.msgs {
+		if m.done != nil {
+			m.done("", err)
+		}
+	}
+}
+
+// lost 关闭过程中丢失的消息计入 CloseContext 的返回值
+func (p *producer) lost(b *sendBatch) {
+	select {
+	case <-p.closing:
+		atomic.AddInt64(&p.dropped, int64(len(b.msgs)))
+	default:
+	}
+}
+
+// replaySpilled 定期按顺序重新发送段文件中的消息，关闭时最后尝试一次，关闭超时后不再尝试。
+// 没有发送的段文件在下次启动时继续发送
+func (p *producer) replaySpilled() {
+	tick := time.NewTicker(p.SpillPeriod)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			if p.abort.Err() == nil {
+				if err := p.replay(); err != nil && p.emitter != nil {
+					p.emitter.EmitError(err)
+				}
+			}
+
+			p.wg.Done()
+			return
+		case <-tick.C:
+		}
+
+		if err := p.replay(); err != nil && p.emitter != nil {
+			p.emitter.EmitError(err)
+		}
+	}
+}
+
+// replay 按顺序重新发送已经关闭的段文件
+func (p *producer) replay() error {
+	segs, err := p.spill.seal()
+	if err != nil {
+		return err
+	}
+
+	for _, seg := range segs {
+		if err := p.replaySegment(seg); err != nil {
+			return err
+		}
+	}
+
+	return p.spill.finish()
+}
+
+// replaySegment 发送一个段文件，成功后删除，失败时段文件中只保留没有发送的消息
+func (p *producer) replaySegment(seg string) error {
+	records, err := readSegment(seg)
+	if err != nil && p.emitter != nil {
+		// 进程退出时最后一行可能没有写完整，之前的消息照常发送
+		p.emitter.EmitError(err)
+	}
+
+	for len(records) > 0 {
+		n := 1
+		for n < len(records) && n < int(p.PipeBufferSize) &&
+			records[n].Lane == records[0].Lane && records[n].Shard == records[0].Shard {
+			n++
+		}
+
+		msgs := make([]*outMessage, n)
+		for i := range msgs {
+			msgs[i] = &outMessage{body: records[i].Body, headers: records[i].Headers}
+		}
+
+		b := p.makeBatch(records[0].Lane, records[0].Shard, msgs)
+		started := time.Now()
+		if _, err := p.append(b); err != nil {
+			if werr := writeSegment(seg, records); werr != nil {
+				return werr
+			}
+
+			return err
+		}
+
+		p.Metrics.Sent(p.QueueName, b.lane, b.shard, n, time.Since(started))
+		records = records[n:]
+	}
+
+	if err := os.Remove(seg); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(seg))
+}
+
+func readSegment(path string) ([]spillRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var records []spillRecord
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var r spillRecord
+		if err := dec.Decode(&r); err != nil {
+			return records, fmt.Errorf("disruptor: read segment %v: %w", path, err)
+		}
+
+		records = append(records, r)
+	}
+
+	return records, nil
+}
+
+// writeSegment 用剩下的消息替换段文件
+func writeSegment(path string, records []spillRecord) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for i := range records {
+		if err := enc.Encode(&records[i]); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir 把目录中文件的创建、删除和改名落盘
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	defer d.Close()
+	return d.Sync()
+}
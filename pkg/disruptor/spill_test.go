@@ -0,0 +1,83 @@
+package disruptor_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sinuxlee/tile/pkg/disruptor"
+	"github.com/sinuxlee/tile/pkg/disruptor/disruptortest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpillDirLocked(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+	dir := t.TempDir()
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: "spill", SpillDir: dir}, cli)
+	require.NoError(t, err)
+
+	// 同一个队列的段文件只能有一个生产者写入，其他队列不受影响，包括以该队列名为前缀的队列
+	_, err = disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: "spill", SpillDir: dir}, cli)
+	assert.Equal(t, disruptor.ErrSpillLocked, err)
+
+	for _, queue := range []string{"other", "spill-b", "spill.lock"} {
+		other, err := disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: queue, SpillDir: dir}, cli)
+		require.NoError(t, err, queue)
+		other.Close()
+	}
+
+	// 关闭后释放锁
+	pr.Close()
+	pr, err = disruptor.NewProducer(&disruptor.ProducerOptions{QueueName: "spill", SpillDir: dir}, cli)
+	require.NoError(t, err)
+	pr.Close()
+}
+
+func TestSpillQueuesIsolated(t *testing.T) {
+	mr, cli := disruptortest.NewRedis(t)
+	dir := t.TempDir()
+	opt := func(queue string) *disruptor.ProducerOptions {
+		return &disruptor.ProducerOptions{
+			QueueName: queue, ShardsCount: 1, PipePeriod: 5 * time.Millisecond, SpillDir: dir, SpillPeriod: 10 * time.Millisecond,
+		}
+	}
+
+	// 名字互为前缀或者包含路径字符的队列各自写入段文件
+	var prs []disruptor.Producer
+	for _, queue := range []string{"a-b", "a/*[0]", ".."} {
+		pr, err := disruptor.NewProducer(opt(queue), cli)
+		require.NoError(t, err)
+		prs = append(prs, pr)
+	}
+
+	mr.SetError("LOADING Redis is loading the dataset in memory")
+	for _, pr := range prs {
+		require.NoError(t, pr.Push(pr.Value(&order{Seq: 1})))
+		dropped, err := pr.CloseContext(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, 0, dropped)
+	}
+	mr.SetError("")
+
+	// 其他队列的生产者不会发送这些段文件
+	pr, err := disruptor.NewProducer(opt("a"), cli)
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	pr.Close()
+
+	info, err := disruptor.Inspect(cli, "a", "", 0)
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, info.Length)
+
+	for _, queue := range []string{"a-b", "a/*[0]", ".."} {
+		pr, err := disruptor.NewProducer(opt(queue), cli)
+		require.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			info, err := disruptor.Inspect(cli, queue, "", 0)
+			return err == nil && info.Length == 1
+		}, 2*time.Second, 10*time.Millisecond, queue)
+		pr.Close()
+	}
+}
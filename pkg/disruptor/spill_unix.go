@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package disruptor
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockDir 以不阻塞的方式对锁文件加 flock，已经被其他生产者持有时返回 ErrSpillLocked。
+// 进程退出时锁自动释放
+func lockDir(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrSpillLocked
+		}
+
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// unlockDir 关闭锁文件释放 flock，锁文件保留
+func unlockDir(f *os.File) error {
+	return f.Close()
+}
@@ -0,0 +1,33 @@
+package disruptor
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockDir 以不阻塞的方式对锁文件加 LockFileEx 独占锁，已经被其他生产者持有时返回 ErrSpillLocked。
+// 进程退出时锁自动释放
+func lockDir(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := uint32(windows.LOCKFILE_EXCLUSIVE_LOCK | windows.LOCKFILE_FAIL_IMMEDIATELY)
+	if err := windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, 1, 0, &windows.Overlapped{}); err != nil {
+		_ = f.Close()
+		if err == windows.ERROR_LOCK_VIOLATION {
+			return nil, ErrSpillLocked
+		}
+
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// unlockDir 关闭锁文件释放锁，锁文件保留
+func unlockDir(f *os.File) error {
+	return f.Close()
+}
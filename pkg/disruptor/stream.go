@@ -0,0 +1,303 @@
+package disruptor
+
+import (
+	"strings"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// lessIDLua 比较两个消息id的 Lua 函数
+const lessIDLua = `
+local function less(a, b)
+	local am, as = string.match(a, '^(%d+)-?(%d*)$')
+	local bm, bs = string.match(b, '^(%d+)-?(%d*)$')
+	if tonumber(am) ~= tonumber(bm) then
+		return tonumber(am) < tonumber(bm)
+	end
+	return (tonumber(as) or 0) < (tonumber(bs) or 0)
+end
+`
+
+// ackDelScript 确认消息，分片上所有的消费组都已经读取并且确认的消息同时删除。
+// 还有消费组没有读取或者没有确认时保留，由最后一个确认的消费组删除。只有一个消费组时直接删除
+var ackDelScript = redis.NewScript(lessIDLua + `
+local n = redis.call('XACK', KEYS[1], ARGV[1], unpack(ARGV, 2))
+
+local info = redis.call('XINFO', 'GROUPS', KEYS[1])
+if #info == 1 then
+	redis.call('XDEL', KEYS[1], unpack(ARGV, 2))
+	return n
+end
+
+local groups = {}
+for _, group in ipairs(info) do
+	local g = {}
+	for i = 1, #group, 2 do
+		g[group[i]] = group[i + 1]
+	end
+	table.insert(groups, g)
+end
+
+local acked = {}
+for i = 2, #ARGV do
+	local id = ARGV[i]
+	local done = true
+	for _, g in ipairs(groups) do
+		if less(g['last-delivered-id'], id) or #redis.call('XPENDING', KEYS[1], g['name'], id, id, 1) > 0 then
+			done = false
+			break
+		end
+	end
+
+	if done then
+		table.insert(acked, id)
+	end
+end
+
+if #acked > 0 then
+	redis.call('XDEL', KEYS[1], unpack(acked))
+end
+return n
+`)
+
+// redisDriver 基于 Redis Streams 的后端，每个分片是一个 stream
+type redisDriver struct {
+	cli       redis.UniversalClient
+	maxLen    int64 // 写入时保留的大约消息数，为0时不限制
+	keepAcked bool  // ack 后是否保留消息
+	tags      *shardTags
+}
+
+// stream 分片的 key，优先级的分片和原来的分片使用相同的 hash tag
+func (d *redisDriver) stream(queue string, shard int) string {
+	tag := ""
+	if d.tags != nil {
+		tag = d.tags.get(shard)
+	}
+
+	return makeStreamName(queue, tag, shard)
+}
+
+// Prepare 分片在第一次写入或者创建消费组时创建，group 为空时不需要做什么
+func (d *redisDriver) Prepare(queue string, shards int, group string) error {
+	if group == "" {
+		return nil
+	}
+
+	start := "$"
+	if group == makeGroupName(queue) {
+		start = "0"
+	}
+
+	for i := 0; i < shards; i++ {
+		if err := d.createShard(d.stream(queue, i), group, start); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createShard 创建分片队列和消费组，队列已经存在时只创建消费组，新的消费组从 start 之后的消息开始消费
+func (d *redisDriver) createShard(stream string, group string, start string) error {
+	xgroup := redis.NewCmd("XGROUP", "CREATE", stream, group, start, "MKSTREAM")
+
+	err := d.cli.Process(xgroup)
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+
+	// Check after creation
+	xinfo := redis.NewCmd("XINFO", "STREAM", stream)
+	err = d.cli.Process(xinfo)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// groups 分片上所有消费组的名字，分片不存在时返回空
+func (d *redisDriver) groups(stream string) ([]string, error) {
+	n, err := d.cli.Exists(stream).Result()
+	if err != nil || n == 0 {
+		return nil, err
+	}
+
+	xinfo := redis.NewSliceCmd("XINFO", "GROUPS", stream)
+	if err := d.cli.Process(xinfo); err != nil {
+		return nil, err
+	}
+
+	groups := make([]string, 0, len(xinfo.Val()))
+	for _, g := range xinfo.Val() {
+		groups = append(groups, infoString(infoFields(g)["name"]))
+	}
+
+	return groups, nil
+}
+
+func (d *redisDriver) Append(queue string, shard int, records []Record) ([]string, error) {
+	stream := d.stream(queue, shard)
+	pipe := d.cli.TxPipeline()
+
+	cmds := make([]*redis.StringCmd, len(records))
+	for i, r := range records {
+		cmds[i] = pipe.XAdd(&redis.XAddArgs{
+			ID:           "*",
+			Stream:       stream,
+			MaxLenApprox: d.maxLen,
+			Values:       encodeFields(r.Body, r.Headers),
+		})
+	}
+
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(cmds))
+	for i, cmd := range cmds {
+		ids[i] = cmd.Val()
+	}
+
+	return ids, nil
+}
+
+func (d *redisDriver) ReadGroup(args *ReadArgs) ([]Record, error) {
+	res, err := d.ReadGroups([]*ReadArgs{args})
+	if err != nil {
+		return nil, err
+	}
+
+	return res[0], nil
+}
+
+// ReadGroups 用一次 XREADGROUP 读取多个分片，集群中这些分片需要位于同一个 slot
+func (d *redisDriver) ReadGroups(args []*ReadArgs) ([][]Record, error) {
+	streams := make([]string, 2*len(args))
+	index := make(map[string]int, len(args))
+	for i, a := range args {
+		id := ">"
+		if a.Backlog {
+			id = a.After
+			if id == "" {
+				id = "0-0"
+			}
+		}
+
+		stream := d.stream(a.Queue, a.Shard)
+		streams[i] = stream
+		streams[len(args)+i] = id
+		index[stream] = i
+	}
+
+	res, err := d.cli.XReadGroup(&redis.XReadGroupArgs{
+		Block:    args[0].Block,
+		Consumer: args[0].Consumer,
+		Count:    args[0].Count,
+		Group:    args[0].Group,
+		Streams:  streams,
+	}).Result()
+
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	records := make([][]Record, len(args))
+	for _, s := range res {
+		i := index[s.Stream]
+		for _, m := range s.Messages {
+			records[i] = append(records[i], decodeRecord(m))
+		}
+	}
+
+	return records, nil
+}
+
+func (d *redisDriver) Ack(queue string, shard int, group string, ids []string) error {
+	stream := d.stream(queue, shard)
+
+	// 保留消息时只确认
+	if d.keepAcked {
+		return d.cli.XAck(stream, group, ids...).Err()
+	}
+
+	args := make([]interface{}, 0, len(ids)+1)
+	args = append(args, group)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	return ackDelScript.Run(d.cli, []string{stream}, args...).Err()
+}
+
+// Claim 按 id 顺序分页扫描 PEL，直到找到 Count 条可以回收的消息，活跃的消费者持有的消息不会挡住后面的消息
+func (d *redisDriver) Claim(args *ClaimArgs) ([]Record, error) {
+	stream := d.stream(args.Queue, args.Shard)
+
+	ids := make([]string, 0, args.Count)
+	owners := make(map[string]string)
+	for start := "-"; int64(len(ids)) < args.Count; {
+		pending, err := d.cli.XPendingExt(&redis.XPendingExtArgs{
+			Stream: stream,
+			Group:  args.Group,
+			Start:  start,
+			End:    "+",
+			Count:  args.Count,
+		}).Result()
+
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+
+		for _, p := range pending {
+			if p.Idle < args.MinIdle || (args.Held != nil && args.Held(p.ID)) || int64(len(ids)) >= args.Count {
+				continue
+			}
+
+			ids = append(ids, p.ID)
+			owners[p.ID] = p.Consumer
+		}
+
+		if int64(len(pending)) < args.Count {
+			break
+		}
+
+		start = nextID(pending[len(pending)-1].ID)
+	}
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	// 在 XPENDING 和 XCLAIM 之间被别人认领的消息，因为空闲时间被重置而不会被重复认领
+	msgs, err := d.cli.XClaim(&redis.XClaimArgs{
+		Stream:   stream,
+		Group:    args.Group,
+		Consumer: args.Consumer,
+		MinIdle:  args.MinIdle,
+		Messages: ids,
+	}).Result()
+
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	records := make([]Record, len(msgs))
+	for i, m := range msgs {
+		records[i] = decodeRecord(m)
+		records[i].Owner = owners[m.ID]
+	}
+
+	return records, nil
+}
+
+// decodeRecord 没有 data 字段的消息 Body 为 nil
+func decodeRecord(m redis.XMessage) Record {
+	r := Record{ID: m.ID, Headers: decodeHeaders(m.Values)}
+	if data, ok := m.Values[dataField].(string); ok {
+		r.Body = []byte(data)
+	}
+
+	return r
+}
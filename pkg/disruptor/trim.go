@@ -0,0 +1,84 @@
+package disruptor
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// minIDScript 按 MINID 裁剪分片，ARGV[1] 是 MaxAge 对应的id，ARGV[2] 是 MaxAge+PendingMaxAge 对应的id。
+// 各个消费组已经读取还没有 ack 的消息最多保留到 ARGV[2]，开启了回收的消费者在这段时间内可以回收下线消费者持有的消息，
+// 没有回收时这些消息超过 ARGV[2] 后被裁剪，不会让分片一直不能裁剪。消费组还没有读取的消息按 ARGV[1] 裁剪
+var minIDScript = redis.NewScript(lessIDLua + `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+
+local minid = ARGV[1]
+for _, group in ipairs(redis.call('XINFO', 'GROUPS', KEYS[1])) do
+	local name
+	for i = 1, #group, 2 do
+		if group[i] == 'name' then
+			name = group[i + 1]
+		end
+	end
+
+	local pending = redis.call('XPENDING', KEYS[1], name)
+	if pending[1] > 0 and less(pending[2], minid) then
+		minid = pending[2]
+	end
+end
+
+if less(minid, ARGV[2]) then
+	minid = ARGV[2]
+end
+
+return redis.call('XTRIM', KEYS[1], 'MINID', '~', minid)
+`)
+
+// trim 定期裁剪分片队列，避免消费者停止消费时队列无限增长
+func (p *producer) trim() {
+	tick := time.NewTicker(p.TrimPeriod)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			p.wg.Done()
+			return
+		case <-tick.C:
+		}
+
+		for lane := 0; lane < p.lanes; lane++ {
+			for i := 0; i < p.shards(); i++ {
+				err := p.trimShard(p.streamOf(lane, i))
+				if err != nil && p.emitter != nil {
+					p.emitter.EmitError(err)
+				}
+			}
+		}
+	}
+}
+
+func (p *producer) trimShard(stream string) error {
+	if p.MaxLen > 0 {
+		err := p.redisClient.XTrimApprox(stream, p.MaxLen).Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.MaxAge > 0 {
+		// 消息id的前半部分是写入时的毫秒时间戳，MINID 需要 Redis 6.2 以上
+		now := time.Now()
+		minID := strconv.FormatInt(now.Add(-p.MaxAge).UnixNano()/int64(time.Millisecond), 10)
+		floorID := strconv.FormatInt(now.Add(-p.MaxAge-p.PendingMaxAge).UnixNano()/int64(time.Millisecond), 10)
+		err := minIDScript.Run(p.redisClient, []string{stream}, minID, floorID).Err()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package disruptor_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/sinuxlee/tile/pkg/disruptor"
+	"github.com/sinuxlee/tile/pkg/disruptor/disruptortest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrimKeepsPending(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{
+		QueueName: "retention", ShardsCount: 1, PipePeriod: 5 * time.Millisecond,
+		MaxAge: 50 * time.Millisecond, TrimPeriod: 10 * time.Millisecond,
+	}, cli)
+	require.NoError(t, err)
+	defer pr.Close()
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		id, err := pr.PushSync(context.Background(), pr.Value(&order{Seq: i}))
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	// 下线的消费者创建了默认消费组，读取了前2条，只 ack 了第1条
+	info, err := disruptor.Inspect(cli, "retention", "", 0)
+	require.NoError(t, err)
+	group, stream := info.Group, info.Shards[0].Stream
+	require.NoError(t, cli.XGroupCreate(stream, group, "0").Err())
+	require.NoError(t, cli.XReadGroup(&redis.XReadGroupArgs{Group: group, Consumer: "dead", Streams: []string{stream, ">"}, Count: 2}).Err())
+	require.NoError(t, cli.XAck(stream, group, ids[0]).Err())
+
+	// 超过 MaxAge 后只裁剪最早的没有 ack 的消息之前的消息
+	time.Sleep(150 * time.Millisecond)
+	msgs, err := cli.XRange(stream, "-", "+").Result()
+	require.NoError(t, err)
+	require.Len(t, msgs, 4)
+	assert.Equal(t, ids[1], msgs[0].ID)
+
+	require.NoError(t, cli.XAck(stream, group, ids[1]).Err())
+	assert.Eventually(t, func() bool { return cli.XLen(stream).Val() == 0 }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestTrimPendingMaxAge(t *testing.T) {
+	_, cli := disruptortest.NewRedis(t)
+
+	pr, err := disruptor.NewProducer(&disruptor.ProducerOptions{
+		QueueName: "stale", ShardsCount: 1, PipePeriod: 5 * time.Millisecond,
+		MaxAge: 50 * time.Millisecond, PendingMaxAge: 200 * time.Millisecond, TrimPeriod: 10 * time.Millisecond,
+	}, cli)
+	require.NoError(t, err)
+	defer pr.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := pr.PushSync(context.Background(), pr.Value(&order{Seq: i}))
+		require.NoError(t, err)
+	}
+
+	// 下线的消费者一直没有 ack，超过 MaxAge+PendingMaxAge 后也被裁剪
+	info, err := disruptor.Inspect(cli, "stale", "", 0)
+	require.NoError(t, err)
+	stream := info.Shards[0].Stream
+	require.NoError(t, cli.XGroupCreate(stream, info.Group, "0").Err())
+	require.NoError(t, cli.XReadGroup(&redis.XReadGroupArgs{Group: info.Group, Consumer: "dead", Streams: []string{stream, ">"}, Count: 1}).Err())
+
+	time.Sleep(100 * time.Millisecond)
+	assert.EqualValues(t, 3, cli.XLen(stream).Val())
+	assert.Eventually(t, func() bool { return cli.XLen(stream).Val() == 0 }, 2*time.Second, 10*time.Millisecond)
+}
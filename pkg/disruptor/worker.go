@@ -0,0 +1,151 @@
+package disruptor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+func (c *consumer) Run(ctx context.Context, workers int, factory func() Marshaler, h Handler) error {
+	return runWorkers(ctx, workers, c.msgChan, factory, h, c.handle, c.release, c.emitter)
+}
+
+// runWorkers 启动 workers 个协程处理 msgChan 中的消息。同一个分片同时只有一条消息在处理，
+// 分片中之后的消息在本地排队，不同分片的消息由空闲的协程并发处理，相同 key 的消息按顺序处理。
+// ctx 结束或者 msgChan 关闭后等待正在处理的消息完成再返回，已经取出还没有开始处理的消息交给 release，
+// 和留在 msgChan 中的消息一样等待重新投递
+func runWorkers(ctx context.Context, workers int, msgChan <-chan Message, factory func() Marshaler, h Handler,
+	handle func(m Message, data Marshaler, h Handler) error, release func(m Message), emitter ErrorNotifier) error {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	safe := recoverHandler(h)
+	tasks := make(chan Message)
+	finished := make(chan Message)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for m := range tasks {
+				err := handle(m, factory(), safe)
+				if err != nil && emitter != nil {
+					emitter.EmitError(err)
+				}
+
+				finished <- m
+			}
+		}()
+	}
+
+	// 本地最多再保存一个 msgChan 的消息，热点分片排队时其他分片的消息仍然可以取出
+	limit := cap(msgChan)
+	if limit < workers {
+		limit = workers
+	}
+
+	order := newShardOrder()
+	in, done := msgChan, ctx.Done()
+	stop := func() {
+		in, done = nil, nil
+		for _, m := range order.drop() {
+			release(m)
+		}
+	}
+
+	for in != nil || order.held > 0 {
+		recv := in
+		if order.held >= limit {
+			recv = nil
+		}
+
+		var next chan<- Message
+		var m Message
+		if len(order.ready) > 0 {
+			next, m = tasks, order.ready[0]
+		}
+
+		select {
+		case msg, more := <-recv:
+			if !more {
+				stop()
+				continue
+			}
+
+			order.push(msg)
+		case next <- m:
+			order.ready = order.ready[1:]
+		case msg := <-finished:
+			order.done(msg)
+		case <-done:
+			stop()
+		}
+	}
+
+	close(tasks)
+	wg.Wait()
+	return ctx.Err()
+}
+
+// shardOrder 记录 runWorkers 已经取出还没有处理完的消息，同一个分片同时只有一条消息交给协程处理
+type shardOrder struct {
+	waiting map[string][]Message // 有消息正在处理或者在 ready 中的分片，以及排在它之后的消息
+	ready   []Message            // 所在分片没有其他消息在处理，可以交给协程的消息
+	held    int
+}
+
+func newShardOrder() *shardOrder {
+	return &shardOrder{waiting: make(map[string][]Message)}
+}
+
+func (o *shardOrder) push(m Message) {
+	o.held++
+	if q, ok := o.waiting[m.Stream]; ok {
+		o.waiting[m.Stream] = append(q, m)
+		return
+	}
+
+	o.waiting[m.Stream] = nil
+	o.ready = append(o.ready, m)
+}
+
+// done 分片的消息处理完成，排在它之后的第一条消息可以处理
+func (o *shardOrder) done(m Message) {
+	o.held--
+	q := o.waiting[m.Stream]
+	if len(q) == 0 {
+		delete(o.waiting, m.Stream)
+		return
+	}
+
+	o.ready = append(o.ready, q[0])
+	o.waiting[m.Stream] = q[1:]
+}
+
+// drop 取出所有还没有开始处理的消息，之后只等待正在处理的消息完成
+func (o *shardOrder) drop() []Message {
+	dropped := o.ready
+	o.ready = nil
+	for stream, q := range o.waiting {
+		dropped = append(dropped, q...)
+		o.waiting[stream] = nil
+	}
+
+	o.held -= len(dropped)
+	return dropped
+}
+
+// recoverHandler 把 handler 的 panic 转换成错误，按处理失败走重试和死信流程
+func recoverHandler(h Handler) Handler {
+	return func(m Message) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("disruptor: handler panic on message %v: %v", m.ID, r)
+			}
+		}()
+
+		return h(m)
+	}
+}